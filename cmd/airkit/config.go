@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jmalloc/airkit/manager"
+	"github.com/jmalloc/airkit/myplace"
+	"github.com/jmalloc/airkit/reconciler"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPollInterval is the interval at which the MyPlace system is polled
+// unless configured otherwise.
+const defaultPollInterval = reconciler.DefaultPollInterval
+
+// defaultStaleAfter is the amount of time after which the state of an
+// air-conditioning unit is considered stale unless configured otherwise.
+const defaultStaleAfter = reconciler.DefaultStaleAfter
+
+// serverConfig is the configuration of the HomeKit accessory server.
+//
+// It is built from the environment, then amended by the configuration file, if
+// there is one.
+type serverConfig struct {
+	ControlMode       string
+	PollInterval      time.Duration
+	StaleAfter        time.Duration
+	EnableThermostats bool
+	EnableFan         bool
+
+	// AirCon is the configuration shared by each AirConManager. Its Zones and
+	// ZoneGroups are set separately for each unit by airConConfig().
+	AirCon manager.AirConConfig
+
+	// Zones is the configuration of specific zones, keyed by the ID of the
+	// air-conditioning unit, then by zone ID.
+	Zones map[string]map[string]manager.ZoneConfig
+
+	// ZoneGroups is the zone groups of each air-conditioning unit, keyed by the
+	// unit's ID.
+	ZoneGroups map[string][]manager.ZoneGroup
+}
+
+// airConConfig returns the configuration of the AirConManager for the
+// air-conditioning unit with the given ID.
+func (c serverConfig) airConConfig(unitID string) manager.AirConConfig {
+	config := c.AirCon
+	config.Zones = c.Zones[unitID]
+	config.ZoneGroups = c.ZoneGroups[unitID]
+	return config
+}
+
+// unknownZones returns the zones that are referenced by the configuration but
+// are not reported by the MyPlace system, in the "<unit>/<zone>" format.
+func (c serverConfig) unknownZones(sys *myplace.System) []string {
+	refs := map[string]struct{}{}
+
+	for unitID, zones := range c.Zones {
+		for zoneID := range zones {
+			refs[unitID+"/"+zoneID] = struct{}{}
+		}
+	}
+
+	for unitID, groups := range c.ZoneGroups {
+		for _, g := range groups {
+			for _, zoneID := range g.Zones {
+				refs[unitID+"/"+zoneID] = struct{}{}
+			}
+		}
+	}
+
+	for _, ac := range sys.AirCons {
+		for _, z := range ac.Zones {
+			delete(refs, ac.ID+"/"+z.ID)
+		}
+	}
+
+	var unknown []string
+	for ref := range refs {
+		unknown = append(unknown, ref)
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// loadServerConfig returns the configuration of the HomeKit accessory server.
+func loadServerConfig() (serverConfig, error) {
+	airCon, err := newAirConConfig()
+	if err != nil {
+		return serverConfig{}, err
+	}
+
+	c := serverConfig{
+		ControlMode:       controlMode.Value(),
+		PollInterval:      defaultPollInterval,
+		StaleAfter:        defaultStaleAfter,
+		EnableThermostats: true,
+		EnableFan:         true,
+		AirCon:            airCon,
+	}
+
+	if v, ok := zoneGroups.Value(); ok {
+		c.ZoneGroups, err = parseZoneGroups(v)
+		if err != nil {
+			return serverConfig{}, fmt.Errorf("AIRKIT_ZONE_GROUPS is invalid: %w", err)
+		}
+	}
+
+	if path, ok := configFile.Value(); ok {
+		if err := c.loadFile(path); err != nil {
+			return serverConfig{}, fmt.Errorf("the configuration file (%s) is invalid: %w", path, err)
+		}
+	}
+
+	switch c.ControlMode {
+	case automationControlMode, passthroughControlMode:
+	default:
+		return serverConfig{}, fmt.Errorf(
+			"unknown control mode (%s), expected %s or %s",
+			c.ControlMode,
+			automationControlMode,
+			passthroughControlMode,
+		)
+	}
+
+	return c, nil
+}
+
+// configFileSchema is the structure of the AirKit configuration file.
+type configFileSchema struct {
+	PollInterval *time.Duration        `yaml:"poll_interval"`
+	StaleAfter   *time.Duration        `yaml:"stale_after"`
+	Control      controlSchema         `yaml:"control"`
+	Accessories  accessoriesSchema     `yaml:"accessories"`
+	Zones        map[string]zoneSchema `yaml:"zones"`
+	Groups       []groupSchema         `yaml:"groups"`
+}
+
+// controlSchema is the structure of the "control" section of the
+// configuration file.
+type controlSchema struct {
+	Mode       *string          `yaml:"mode"`
+	Strategy   *string          `yaml:"strategy"`
+	Thresholds thresholdsSchema `yaml:"thresholds"`
+}
+
+// accessoriesSchema is the structure of the "accessories" section of the
+// configuration file.
+type accessoriesSchema struct {
+	Thermostats *bool `yaml:"thermostats"`
+	Fan         *bool `yaml:"fan"`
+}
+
+// zoneSchema is the structure of each entry in the "zones" section of the
+// configuration file, which is keyed by unit and zone ID, such as "ac1/z01".
+type zoneSchema struct {
+	Hidden            bool             `yaml:"hidden"`
+	Name              string           `yaml:"name"`
+	MinTemp           float64          `yaml:"min_temp"`
+	MaxTemp           float64          `yaml:"max_temp"`
+	CalibrationOffset float64          `yaml:"calibration_offset"`
+	Thresholds        thresholdsSchema `yaml:"thresholds"`
+}
+
+// groupSchema is the structure of each entry in the "groups" section of the
+// configuration file. Its zones are identified by unit and zone ID, such as
+// "ac1/z01", and must all belong to the same unit.
+type groupSchema struct {
+	Name      string   `yaml:"name"`
+	Zones     []string `yaml:"zones"`
+	Aggregate string   `yaml:"aggregate"`
+}
+
+// thresholdsSchema is the structure of a set of thresholds within the
+// configuration file. Any thresholds that are not specified are inherited.
+type thresholdsSchema struct {
+	CoolStart *float64 `yaml:"cool_start"`
+	CoolStop  *float64 `yaml:"cool_stop"`
+	HeatStart *float64 `yaml:"heat_start"`
+	HeatStop  *float64 `yaml:"heat_stop"`
+}
+
+// isZero returns true if none of the thresholds are specified.
+func (s thresholdsSchema) isZero() bool {
+	return s == thresholdsSchema{}
+}
+
+// apply returns t with any thresholds specified in s replaced.
+func (s thresholdsSchema) apply(t manager.Thresholds) (manager.Thresholds, error) {
+	for _, x := range []struct {
+		Src  *float64
+		Dest *float64
+	}{
+		{s.CoolStart, &t.CoolStart},
+		{s.CoolStop, &t.CoolStop},
+		{s.HeatStart, &t.HeatStart},
+		{s.HeatStop, &t.HeatStop},
+	} {
+		if x.Src != nil {
+			*x.Dest = *x.Src
+		}
+	}
+
+	return t, t.Validate()
+}
+
+// loadFile amends the configuration with the content of the file at the given
+// path.
+func (c *serverConfig) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f configFileSchema
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if f.PollInterval != nil {
+		if *f.PollInterval <= 0 {
+			return fmt.Errorf("poll_interval must be positive")
+		}
+
+		c.PollInterval = *f.PollInterval
+	}
+
+	if f.StaleAfter != nil {
+		if *f.StaleAfter <= 0 {
+			return fmt.Errorf("stale_after must be positive")
+		}
+
+		c.StaleAfter = *f.StaleAfter
+	}
+
+	if f.Control.Mode != nil {
+		c.ControlMode = *f.Control.Mode
+	}
+
+	if f.Control.Strategy != nil {
+		c.AirCon.Strategy, err = manager.NewControlStrategy(*f.Control.Strategy)
+		if err != nil {
+			return fmt.Errorf("control.strategy: %w", err)
+		}
+	}
+
+	thresholds, err := f.Control.Thresholds.apply(*c.AirCon.Thresholds)
+	if err != nil {
+		return fmt.Errorf("control.thresholds: %w", err)
+	}
+	c.AirCon.Thresholds = &thresholds
+
+	if f.Accessories.Thermostats != nil {
+		c.EnableThermostats = *f.Accessories.Thermostats
+	}
+
+	if f.Accessories.Fan != nil {
+		c.EnableFan = *f.Accessories.Fan
+	}
+
+	if len(f.Zones) != 0 {
+		c.Zones = map[string]map[string]manager.ZoneConfig{}
+	}
+
+	for id, z := range f.Zones {
+		unitID, zoneID, err := parseZoneRef(id)
+		if err != nil {
+			return fmt.Errorf("zones.%s: %w", id, err)
+		}
+
+		zc := manager.ZoneConfig{
+			Hidden:            z.Hidden,
+			Name:              z.Name,
+			MinTemp:           z.MinTemp,
+			MaxTemp:           z.MaxTemp,
+			CalibrationOffset: z.CalibrationOffset,
+		}
+
+		if !z.Thresholds.isZero() {
+			t, err := z.Thresholds.apply(thresholds)
+			if err != nil {
+				return fmt.Errorf("zones.%s.thresholds: %w", id, err)
+			}
+			zc.Thresholds = &t
+		}
+
+		if err := zc.Validate(); err != nil {
+			return fmt.Errorf("zones.%s: %w", id, err)
+		}
+
+		if c.Zones[unitID] == nil {
+			c.Zones[unitID] = map[string]manager.ZoneConfig{}
+		}
+		c.Zones[unitID][zoneID] = zc
+	}
+
+	if len(f.Groups) != 0 {
+		groups := map[string][]manager.ZoneGroup{}
+
+		for _, g := range f.Groups {
+			if err := addZoneGroup(groups, g.Name, g.Zones, g.Aggregate); err != nil {
+				return fmt.Errorf("groups: %w", err)
+			}
+		}
+
+		if err := validateZoneGroups(groups); err != nil {
+			return fmt.Errorf("groups: %w", err)
+		}
+
+		c.ZoneGroups = groups
+	}
+
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmalloc/airkit/manager"
+)
+
+func TestServerConfig_loadFile(t *testing.T) {
+	t.Run("it keeps the existing configuration if the file is empty", func(t *testing.T) {
+		c := loadTestConfig(t, "")
+
+		if expect := newTestConfig(); !reflect.DeepEqual(c, expect) {
+			t.Fatalf("unexpected configuration: got %+v, want %+v", c, expect)
+		}
+	})
+
+	t.Run("it amends the configuration", func(t *testing.T) {
+		c := loadTestConfig(t, `
+poll_interval: 10s
+stale_after: 2m
+control:
+  mode: passthrough
+  strategy: majority-demand
+  thresholds:
+    cool_start: 1.0
+accessories:
+  thermostats: false
+  fan: false
+`)
+
+		if c.PollInterval != 10*time.Second {
+			t.Fatalf("unexpected poll interval: got %s, want 10s", c.PollInterval)
+		}
+
+		if c.StaleAfter != 2*time.Minute {
+			t.Fatalf("unexpected stale duration: got %s, want 2m", c.StaleAfter)
+		}
+
+		if c.ControlMode != passthroughControlMode {
+			t.Fatalf("unexpected control mode: got %s, want %s", c.ControlMode, passthroughControlMode)
+		}
+
+		if _, ok := c.AirCon.Strategy.(manager.MajorityDemand); !ok {
+			t.Fatalf("unexpected strategy: got %T, want manager.MajorityDemand", c.AirCon.Strategy)
+		}
+
+		expect := manager.DefaultThresholds
+		expect.CoolStart = 1.0
+
+		if *c.AirCon.Thresholds != expect {
+			t.Fatalf("unexpected thresholds: got %+v, want %+v", *c.AirCon.Thresholds, expect)
+		}
+
+		if c.EnableThermostats || c.EnableFan {
+			t.Fatal("expected the accessories to be disabled")
+		}
+	})
+
+	t.Run("it inherits zone thresholds from the control thresholds", func(t *testing.T) {
+		c := loadTestConfig(t, `
+control:
+  thresholds:
+    cool_start: 1.0
+zones:
+  ac1/z01:
+    thresholds:
+      heat_start: 1.5
+  ac1/z02:
+    name: Kitchen
+`)
+
+		expect := manager.DefaultThresholds
+		expect.CoolStart = 1.0
+		expect.HeatStart = 1.5
+
+		zones := c.airConConfig("ac1").Zones
+
+		if th := zones["z01"].Thresholds; th == nil || *th != expect {
+			t.Fatalf("unexpected thresholds for ac1/z01: got %+v, want %+v", th, expect)
+		}
+
+		if th := zones["z02"].Thresholds; th != nil {
+			t.Fatalf("unexpected thresholds for ac1/z02: got %+v, want nil", *th)
+		}
+	})
+
+	t.Run("it keys zones and groups by unit", func(t *testing.T) {
+		c := loadTestConfig(t, `
+zones:
+  ac1/z01:
+    name: Lounge
+  ac2/z01:
+    hidden: true
+groups:
+  - name: Living Area
+    zones: [ac1/z02, ac1/z03]
+  - name: Bedrooms
+    zones: [ac2/z02, ac2/z03]
+    aggregate: max
+`)
+
+		if z := c.airConConfig("ac1").Zones["z01"]; z.Name != "Lounge" || z.Hidden {
+			t.Fatalf("unexpected configuration for ac1/z01: %+v", z)
+		}
+
+		if z := c.airConConfig("ac2").Zones["z01"]; z.Name != "" || !z.Hidden {
+			t.Fatalf("unexpected configuration for ac2/z01: %+v", z)
+		}
+
+		expect := []manager.ZoneGroup{
+			{Name: "Bedrooms", Zones: []string{"z02", "z03"}, Aggregate: manager.MaxTemp},
+		}
+
+		if g := c.airConConfig("ac2").ZoneGroups; !reflect.DeepEqual(g, expect) {
+			t.Fatalf("unexpected groups for ac2: got %+v, want %+v", g, expect)
+		}
+	})
+
+	cases := []struct {
+		Name string
+		Data string
+	}{
+		{
+			"file with unknown settings",
+			"poll_intervals: 10s\n",
+		},
+		{
+			"non-positive poll interval",
+			"poll_interval: 0s\n",
+		},
+		{
+			"non-positive stale duration",
+			"stale_after: -1m\n",
+		},
+		{
+			"unknown control strategy",
+			"control:\n  strategy: favour-heating\n",
+		},
+		{
+			"control threshold that stops cooling before it starts",
+			"control:\n  thresholds:\n    cool_start: -0.5\n",
+		},
+		{
+			"zone threshold that stops heating before it starts",
+			"zones:\n  ac1/z01:\n    thresholds:\n      heat_stop: -1.0\n",
+		},
+		{
+			"zone with temperature limits closer than the comfort band",
+			"zones:\n  ac1/z01:\n    min_temp: 22\n    max_temp: 22.5\n",
+		},
+		{
+			"zone without a unit",
+			"zones:\n  z01:\n    hidden: true\n",
+		},
+		{
+			"group with zones of more than one unit",
+			"groups:\n  - name: Mixed\n    zones: [ac1/z01, ac2/z02]\n",
+		},
+		{
+			"zone in more than one group",
+			"groups:\n  - name: A\n    zones: [ac1/z01, ac1/z02]\n  - name: B\n    zones: [ac1/z02, ac1/z03]\n",
+		},
+	}
+
+	for _, x := range cases {
+		x := x // capture loop variable
+
+		t.Run("it rejects a "+x.Name, func(t *testing.T) {
+			c := newTestConfig()
+			if err := c.loadFile(writeTestFile(t, x.Data)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestThresholdsSchema_apply(t *testing.T) {
+	v := func(f float64) *float64 { return &f }
+
+	base := manager.Thresholds{
+		CoolStart: 0.2,
+		CoolStop:  0.1,
+		HeatStart: 0.5,
+		HeatStop:  -0.2,
+	}
+
+	cases := []struct {
+		Name   string
+		Schema thresholdsSchema
+		Expect manager.Thresholds
+		Error  string
+	}{
+		{
+			"nothing specified",
+			thresholdsSchema{},
+			base,
+			"",
+		},
+		{
+			"some thresholds specified",
+			thresholdsSchema{CoolStop: v(0.3), HeatStart: v(1)},
+			manager.Thresholds{CoolStart: 0.2, CoolStop: 0.3, HeatStart: 1, HeatStop: -0.2},
+			"",
+		},
+		{
+			"all thresholds specified",
+			thresholdsSchema{CoolStart: v(1), CoolStop: v(0), HeatStart: v(2), HeatStop: v(0.5)},
+			manager.Thresholds{CoolStart: 1, CoolStop: 0, HeatStart: 2, HeatStop: 0.5},
+			"",
+		},
+		{
+			"cooling stops before it starts",
+			thresholdsSchema{CoolStop: v(-0.5)},
+			manager.Thresholds{},
+			"cooling would stop (+0.5°C) before it starts (+0.2°C)",
+		},
+		{
+			"heating stops before it starts",
+			thresholdsSchema{HeatStop: v(-1)},
+			manager.Thresholds{},
+			"heating would stop (-1.0°C) before it starts (-0.5°C)",
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			actual, err := c.Schema.apply(base)
+
+			if c.Error != "" {
+				if err == nil || err.Error() != c.Error {
+					t.Fatalf("unexpected error: got %v, want %q", err, c.Error)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != c.Expect {
+				t.Fatalf("unexpected thresholds: got %+v, want %+v", actual, c.Expect)
+			}
+		})
+	}
+}
+
+// loadTestConfig returns the default configuration amended by the given
+// configuration file content.
+func loadTestConfig(t *testing.T, data string) serverConfig {
+	t.Helper()
+
+	c := newTestConfig()
+	if err := c.loadFile(writeTestFile(t, data)); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestServerConfig_unknownZones(t *testing.T) {
+	sys := parse(t, `{"aircons": {
+		"ac1": {"info": {"name": "AC"}, "zones": {
+			"z01": {"number": 1, "name": "Living"},
+			"z02": {"number": 2, "name": "Kitchen"}
+		}}
+	}}`)
+
+	c := newTestConfig()
+	c.Zones = map[string]map[string]manager.ZoneConfig{
+		"ac1": {"z01": {}, "z03": {}},
+		"ac2": {"z01": {}},
+	}
+	c.ZoneGroups = map[string][]manager.ZoneGroup{
+		"ac1": {{Name: "Downstairs", Zones: []string{"z02", "z04"}}},
+	}
+
+	got := c.unknownZones(sys)
+	want := []string{"ac1/z03", "ac1/z04", "ac2/z01"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected unknown zones: got %v, want %v", got, want)
+	}
+
+	c.Zones = nil
+	c.ZoneGroups = nil
+
+	if got := c.unknownZones(sys); len(got) != 0 {
+		t.Fatalf("unexpected unknown zones: %v", got)
+	}
+}
+
+// newTestConfig returns a configuration that is equivalent to the one built
+// from the default environment.
+func newTestConfig() serverConfig {
+	thresholds := manager.DefaultThresholds
+
+	return serverConfig{
+		ControlMode:       automationControlMode,
+		PollInterval:      defaultPollInterval,
+		StaleAfter:        defaultStaleAfter,
+		EnableThermostats: true,
+		EnableFan:         true,
+		AirCon: manager.AirConConfig{
+			Thresholds: &thresholds,
+		},
+	}
+}
+
+// writeTestFile writes data to a temporary file and returns its path.
+func writeTestFile(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "airkit.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/jmalloc/airkit/manager"
+	"github.com/jmalloc/airkit/myplace"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	root.AddCommand(&cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose problems that prevent the HomeKit accessory server from working.",
+		Args:  cobra.NoArgs,
+		RunE: func(
+			cmd *cobra.Command,
+			args []string,
+		) error {
+			cmd.SilenceUsage = true
+
+			ctx := cmd.Context()
+			d := &doctor{
+				cli: &myplace.Client{
+					Host: apiHost.Value(),
+					Port: apiPort.Value(),
+				},
+			}
+
+			checks := []struct {
+				Description string
+				Check       func(context.Context) *diagnosis
+			}{
+				{
+					fmt.Sprintf("the MyPlace API is reachable at %s", net.JoinHostPort(apiHost.Value(), apiPort.Value())),
+					d.checkAPIReachable,
+				},
+				{"the MyPlace system data is valid", d.checkSystemData},
+				{fmt.Sprintf("the database directory (%s) is writable", dbPath.Value()), d.checkDatabaseWritable},
+				{"the mDNS multicast socket can be opened", d.checkMulticast},
+				{"the HomeKit PIN is valid", d.checkPIN},
+				{"no other AirKit bridge is being advertised", d.checkDuplicateBridges},
+			}
+
+			problems := 0
+
+			for _, c := range checks {
+				diag := c.Check(ctx)
+
+				if diag == nil {
+					cmd.Printf("ok    %s\n", c.Description)
+				} else if diag.Skipped {
+					cmd.Printf("skip  %s\n", c.Description)
+					cmd.Printf("      %s\n", diag.Problem)
+				} else {
+					problems++
+					cmd.Printf("FAIL  %s\n", c.Description)
+					cmd.Printf("      %s\n", diag.Problem)
+					cmd.Printf("      fix: %s\n", diag.Fix)
+				}
+			}
+
+			if problems == 1 {
+				return fmt.Errorf("found 1 problem")
+			} else if problems != 0 {
+				return fmt.Errorf("found %d problems", problems)
+			}
+
+			return nil
+		},
+	})
+}
+
+// diagnosis describes a problem found by a diagnostic check.
+type diagnosis struct {
+	Problem string
+	Fix     string
+	Skipped bool
+}
+
+// skipped returns a diagnosis indicating that a check could not be performed.
+func skipped(format string, args ...any) *diagnosis {
+	return &diagnosis{
+		Problem: fmt.Sprintf(format, args...),
+		Skipped: true,
+	}
+}
+
+// doctor performs diagnostic checks.
+type doctor struct {
+	cli  *myplace.Client
+	data []byte
+}
+
+// checkAPIReachable checks that the MyPlace API server responds to requests.
+func (d *doctor) checkAPIReachable(ctx context.Context) *diagnosis {
+	fix := "check that AIRKIT_API_HOST and AIRKIT_API_PORT refer to the MyAir Touch Panel, and that the MyPlace app is running on the panel"
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(
+		ctx,
+		"tcp",
+		net.JoinHostPort(d.cli.Host, d.cli.Port),
+	)
+	if err != nil {
+		return &diagnosis{
+			Problem: fmt.Sprintf("unable to connect: %s", err),
+			Fix:     fix,
+		}
+	}
+	conn.Close()
+
+	d.data, err = d.cli.ReadRaw(ctx)
+	if err != nil {
+		return &diagnosis{
+			Problem: fmt.Sprintf("unable to read the system data: %s", err),
+			Fix:     fix,
+		}
+	}
+
+	return nil
+}
+
+// checkSystemData checks that the data returned by the MyPlace API can be
+// parsed.
+func (d *doctor) checkSystemData(ctx context.Context) *diagnosis {
+	if d.data == nil {
+		return skipped("the system data could not be read")
+	}
+
+	fix := "report an issue including the output of 'airkit dump --redact'"
+
+	s, err := myplace.ParseSystem(d.data)
+	if err != nil {
+		return &diagnosis{
+			Problem: fmt.Sprintf("unable to parse the system data: %s", err),
+			Fix:     fix,
+		}
+	}
+
+	if len(s.AirCons) == 0 {
+		return &diagnosis{
+			Problem: "the system data does not contain any air-conditioning units",
+			Fix:     "check that the MyAir Touch Panel is connected to the air-conditioning unit",
+		}
+	}
+
+	for _, ac := range s.AirCons {
+		if len(ac.Zones) == 0 {
+			return &diagnosis{
+				Problem: fmt.Sprintf("the '%s' air-conditioning unit (%s) does not have any zones", ac.Details.Name, ac.ID),
+				Fix:     fix,
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDatabaseWritable checks that AirKit can write to its database
+// directory.
+func (d *doctor) checkDatabaseWritable(ctx context.Context) *diagnosis {
+	fix := fmt.Sprintf(
+		"check that AIRKIT_DB_PATH refers to a directory that can be written by user #%d",
+		os.Getuid(),
+	)
+
+	if err := os.MkdirAll(dbPath.Value(), 0755); err != nil {
+		return &diagnosis{
+			Problem: fmt.Sprintf("unable to create the directory: %s", err),
+			Fix:     fix,
+		}
+	}
+
+	f, err := os.CreateTemp(dbPath.Value(), ".airkit-doctor-*")
+	if err != nil {
+		return &diagnosis{
+			Problem: fmt.Sprintf("unable to create a file: %s", err),
+			Fix:     fix,
+		}
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+
+	return nil
+}
+
+// checkMulticast checks that AirKit can listen for mDNS (Bonjour) queries,
+// which is necessary for HomeKit to discover the bridge.
+func (d *doctor) checkMulticast(ctx context.Context) *diagnosis {
+	conn, err := net.ListenMulticastUDP(
+		"udp4",
+		nil,
+		&net.UDPAddr{
+			IP:   net.IPv4(224, 0, 0, 251),
+			Port: 5353,
+		},
+	)
+	if err != nil {
+		return &diagnosis{
+			Problem: fmt.Sprintf("unable to listen for mDNS queries: %s", err),
+			Fix:     "run AirKit with host networking (network_mode: host in Docker Compose) and allow multicast traffic on UDP port 5353",
+		}
+	}
+
+	conn.Close()
+
+	return nil
+}
+
+// checkPIN checks that the HomeKit PIN is valid and not easily guessed.
+func (d *doctor) checkPIN(ctx context.Context) *diagnosis {
+	pin, ok := homekitPIN.Value()
+	if !ok {
+		// The PIN is generated randomly.
+		return nil
+	}
+
+	fix := "unset AIRKIT_HOMEKIT_PIN to use a randomly generated PIN"
+
+	if err := validatePIN(pin); err != nil {
+		return &diagnosis{
+			Problem: err.Error(),
+			Fix:     fix,
+		}
+	}
+
+	if isTrivialPIN(pin) {
+		return &diagnosis{
+			Problem: fmt.Sprintf("the PIN %s is easily guessed", pin),
+			Fix:     fix,
+		}
+	}
+
+	return nil
+}
+
+// checkDuplicateBridges checks that there are no other AirKit bridges
+// advertised on the local network.
+//
+// The bridge advertised by an 'airkit serve' instance that uses the same
+// database is not a problem in itself, unless it is advertised by more than
+// one host or port.
+func (d *doctor) checkDuplicateBridges(ctx context.Context) *diagnosis {
+	var uuid string
+	if v, err := os.ReadFile(filepath.Join(dbPath.Value(), "uuid")); err == nil {
+		uuid = string(v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var (
+		m       sync.Mutex
+		entries []dnssd.BrowseEntry
+	)
+
+	err := dnssd.LookupType(
+		ctx,
+		"_hap._tcp.local.",
+		func(e dnssd.BrowseEntry) {
+			m.Lock()
+			entries = append(entries, e)
+			m.Unlock()
+		},
+		func(e dnssd.BrowseEntry) {},
+	)
+	if err != nil && err != context.DeadlineExceeded {
+		return skipped("unable to browse for HomeKit accessories: %s", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	duplicates := duplicateBridges(entries, uuid)
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	diag := &diagnosis{
+		Problem: "found a HomeKit bridge advertised as",
+		Fix:     "stop any other AirKit instances, or ensure that they use separate databases",
+	}
+
+	for i, e := range duplicates {
+		if i > 0 {
+			diag.Problem += ","
+		}
+		diag.Problem += fmt.Sprintf(" '%s' at %s:%d", e.Name, e.Host, e.Port)
+	}
+
+	return diag
+}
+
+// duplicateBridges returns the entries that advertise a bridge that conflicts
+// with the bridge that has the given ID.
+//
+// Entries are conflicting if they advertise another AirKit bridge, or if more
+// than one host or port advertises the bridge with the given ID. The same
+// bridge is usually reported once for each network interface, so entries with
+// the same host and port are only returned once.
+func duplicateBridges(entries []dnssd.BrowseEntry, id string) []dnssd.BrowseEntry {
+	var same, other []dnssd.BrowseEntry
+	seen := map[string]bool{}
+
+	for _, e := range entries {
+		k := fmt.Sprintf("%s:%d", e.Host, e.Port)
+		if seen[k] {
+			continue
+		}
+
+		if id != "" && e.Text["id"] == id {
+			seen[k] = true
+			same = append(same, e)
+		} else if e.Text["md"] == manager.BridgeName {
+			seen[k] = true
+			other = append(other, e)
+		}
+	}
+
+	if len(same) > 1 {
+		return append(same, other...)
+	}
+
+	return other
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/brutella/dnssd"
+	"github.com/jmalloc/airkit/manager"
+)
+
+func TestDuplicateBridges(t *testing.T) {
+	const id = "AA:BB:CC:DD:EE:FF"
+
+	local := dnssd.BrowseEntry{
+		Name: "AirKit",
+		Host: "local",
+		Port: 51826,
+		Text: map[string]string{"id": id, "md": manager.BridgeName},
+	}
+
+	copied := dnssd.BrowseEntry{
+		Name: "AirKit",
+		Host: "other",
+		Port: 51826,
+		Text: map[string]string{"id": id, "md": manager.BridgeName},
+	}
+
+	another := dnssd.BrowseEntry{
+		Name: "AirKit (2)",
+		Host: "other",
+		Port: 51827,
+		Text: map[string]string{"id": "11:22:33:44:55:66", "md": manager.BridgeName},
+	}
+
+	unrelated := dnssd.BrowseEntry{
+		Name: "Lights",
+		Host: "hub",
+		Port: 8080,
+		Text: map[string]string{"id": "66:55:44:33:22:11", "md": "Hub"},
+	}
+
+	cases := []struct {
+		Name    string
+		Entries []dnssd.BrowseEntry
+		Expect  []dnssd.BrowseEntry
+	}{
+		{
+			"the local bridge",
+			[]dnssd.BrowseEntry{local, unrelated},
+			nil,
+		},
+		{
+			"the local bridge on several interfaces",
+			[]dnssd.BrowseEntry{local, local},
+			nil,
+		},
+		{
+			"another advertiser of the same bridge",
+			[]dnssd.BrowseEntry{local, copied},
+			[]dnssd.BrowseEntry{local, copied},
+		},
+		{
+			"another AirKit bridge",
+			[]dnssd.BrowseEntry{local, another, another},
+			[]dnssd.BrowseEntry{another},
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			actual := duplicateBridges(c.Entries, id)
+
+			if !reflect.DeepEqual(actual, c.Expect) {
+				t.Fatalf("unexpected duplicates: got %v, want %v", actual, c.Expect)
+			}
+		})
+	}
+}
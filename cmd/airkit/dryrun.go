@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/jmalloc/airkit/myplace"
+	"github.com/jmalloc/airkit/reconciler"
+)
+
+// dryRunClient is a reconciler.Client that reads from the MyPlace system but
+// never writes to it.
+//
+// Instead, commands are applied to an in-memory copy of the system state, such
+// that the accessory managers see the effects of their own commands. Each
+// change is discarded once the setting it applies to is changed within the
+// MyPlace system itself, such as by using the wall panel.
+type dryRunClient struct {
+	Client reconciler.Client
+
+	m       sync.Mutex
+	actual  map[string]any
+	changes map[string]dryRunChange
+}
+
+// dryRunChange is a change to a single setting made by a command that was not
+// sent to the MyPlace system.
+type dryRunChange struct {
+	// Value is the value that the command sets.
+	Value any
+
+	// Actual is the value of the setting within the MyPlace system at the time
+	// the command would have been sent.
+	Actual any
+}
+
+// ReadRaw reads the state of the MyPlace system, then applies the changes made
+// by the commands that were not sent.
+func (c *dryRunClient) ReadRaw(ctx context.Context) ([]byte, error) {
+	data, err := c.Client.ReadRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leave it to the caller to report any problems with the data.
+	s, err := myplace.ParseSystem(data)
+	if err != nil {
+		return data, nil
+	}
+
+	var tree map[string]any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return data, nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.actual = s.Values()
+
+	for p, ch := range c.changes {
+		if c.actual[p] != ch.Actual {
+			delete(c.changes, p)
+			continue
+		}
+
+		setPath(tree, "aircons."+p, ch.Value)
+	}
+
+	return json.Marshal(tree)
+}
+
+// Write applies the changes made by the given commands to the in-memory copy of
+// the system state, without sending them to the MyPlace system.
+func (c *dryRunClient) Write(_ context.Context, commands ...myplace.Command) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.changes == nil {
+		c.changes = map[string]dryRunChange{}
+	}
+
+	for _, cmd := range commands {
+		for p, v := range cmd.Changes() {
+			c.changes[p] = dryRunChange{
+				Value:  v,
+				Actual: c.actual[p],
+			}
+		}
+	}
+
+	return nil
+}
+
+// setPath sets the value at the given dot-separated path within a JSON
+// document, creating any objects along the path that do not exist.
+func setPath(tree map[string]any, path string, v any) {
+	keys := strings.Split(path, ".")
+
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := tree[k].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			tree[k] = next
+		}
+		tree = next
+	}
+
+	tree[keys[len(keys)-1]] = v
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestDryRunClient(t *testing.T) {
+	ctx := context.Background()
+
+	upstream := &fakeClient{
+		Data: `{"aircons": {"ac1": {"info": {"name": "AC", "state": "on", "mode": "cool"}, "zones": {
+			"z01": {"number": 1, "name": "Living", "state": "open"},
+			"z02": {"number": 2, "name": "Kitchen", "state": "open"}
+		}}}}`,
+	}
+
+	c := &dryRunClient{Client: upstream}
+
+	read := func(t *testing.T) *myplace.AirCon {
+		t.Helper()
+
+		data, err := c.ReadRaw(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sys, err := myplace.ParseSystem(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sys.AirConByID["ac1"]
+	}
+
+	ac := read(t)
+
+	t.Run("it does not write to the MyPlace system", func(t *testing.T) {
+		if err := c.Write(
+			ctx,
+			myplace.SetAirConMode("ac1", myplace.AirConModeHeat),
+			myplace.SetZoneState("ac1", ac.ZoneByID["z01"], myplace.ZoneStateClosed),
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		if upstream.Writes != 0 {
+			t.Fatalf("unexpected number of writes: got %d, want 0", upstream.Writes)
+		}
+	})
+
+	t.Run("it applies the commands to the state that it reads", func(t *testing.T) {
+		ac := read(t)
+
+		if ac.Details.Mode != myplace.AirConModeHeat {
+			t.Fatalf("unexpected mode: got %s, want %s", ac.Details.Mode, myplace.AirConModeHeat)
+		}
+
+		if s := ac.ZoneByID["z01"].State; s != myplace.ZoneStateClosed {
+			t.Fatalf("unexpected state of z01: got %s, want %s", s, myplace.ZoneStateClosed)
+		}
+
+		if s := ac.ZoneByID["z02"].State; s != myplace.ZoneStateOpen {
+			t.Fatalf("unexpected state of z02: got %s, want %s", s, myplace.ZoneStateOpen)
+		}
+	})
+
+	t.Run("it discards a change once the setting is changed in the MyPlace system", func(t *testing.T) {
+		upstream.Data = strings.Replace(upstream.Data, `"mode": "cool"`, `"mode": "vent"`, 1)
+
+		ac := read(t)
+
+		if ac.Details.Mode != myplace.AirConModeVent {
+			t.Fatalf("unexpected mode: got %s, want %s", ac.Details.Mode, myplace.AirConModeVent)
+		}
+
+		if s := ac.ZoneByID["z01"].State; s != myplace.ZoneStateClosed {
+			t.Fatalf("unexpected state of z01: got %s, want %s", s, myplace.ZoneStateClosed)
+		}
+
+		upstream.Data = strings.Replace(upstream.Data, `"mode": "vent"`, `"mode": "cool"`, 1)
+
+		if ac := read(t); ac.Details.Mode != myplace.AirConModeCool {
+			t.Fatalf("unexpected mode: got %s, want %s", ac.Details.Mode, myplace.AirConModeCool)
+		}
+	})
+}
+
+// fakeClient is a reconciler.Client that reads a fixed state and counts the
+// number of writes.
+type fakeClient struct {
+	Data   string
+	Writes int
+}
+
+func (c *fakeClient) ReadRaw(context.Context) ([]byte, error) {
+	return []byte(c.Data), nil
+}
+
+func (c *fakeClient) Write(context.Context, ...myplace.Command) error {
+	c.Writes++
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/dogmatiq/imbue"
+	"github.com/jmalloc/airkit/myplace"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Print the raw system data reported by the MyPlace API.",
+		RunE: func(
+			cmd *cobra.Command,
+			args []string,
+		) error {
+			redact, err := cmd.Flags().GetBool("redact")
+			if err != nil {
+				return err
+			}
+
+			cmd.SilenceUsage = true
+
+			return imbue.Invoke1(
+				cmd.Context(),
+				container,
+				func(
+					ctx context.Context,
+					cli *myplace.Client,
+				) error {
+					data, err := cli.ReadRaw(ctx)
+					if err != nil {
+						return err
+					}
+
+					if redact {
+						data, err = redactSystemData(data)
+					} else {
+						data, err = indentSystemData(data)
+					}
+					if err != nil {
+						return err
+					}
+
+					_, err = cmd.OutOrStdout().Write(data)
+					return err
+				},
+			)
+		},
+	}
+
+	cmd.Flags().Bool("redact", false, "Redact device identifiers and location information")
+
+	root.AddCommand(cmd)
+}
+
+// redactedSystemDataKeys is the set of keys within the system data that are
+// removed by redactSystemData().
+var redactedSystemDataKeys = map[string]struct{}{
+	"deviceIds":   {},
+	"deviceIdsV2": {},
+	"rid":         {},
+	"latitude":    {},
+	"longitude":   {},
+	"postCode":    {},
+}
+
+// indentSystemData formats raw system data for output.
+func indentSystemData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "    "); err != nil {
+		return nil, err
+	}
+
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
+// redactSystemData formats raw system data for output, replacing the values
+// of any sensitive keys with empty values of the same type.
+func redactSystemData(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	redactValue(v)
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// redactValue recursively redacts sensitive keys within v.
+func redactValue(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			if _, ok := redactedSystemDataKeys[k]; ok {
+				v[k] = emptyValue(x)
+			} else {
+				redactValue(x)
+			}
+		}
+	case []any:
+		for _, x := range v {
+			redactValue(x)
+		}
+	}
+}
+
+// emptyValue returns the empty value of the same JSON type as v.
+func emptyValue(v any) any {
+	switch v.(type) {
+	case map[string]any:
+		return map[string]any{}
+	case []any:
+		return []any{}
+	case json.Number:
+		return json.Number("0")
+	case string:
+		return ""
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactSystemData(t *testing.T) {
+	data, err := redactSystemData([]byte(`{
+		"aircons": {"ac1": {"info": {"name": "AC", "setTemp": 24.0, "uid": "0f038"}}},
+		"system": {
+			"deviceIds": ["abc", "def"],
+			"deviceIdsV2": {"abc": {"name": "Phone"}},
+			"rid": "APHfgvBXznVqBL5l1QMsuyBCOns1",
+			"latitude": -27.3645676,
+			"longitude": 152.9806543,
+			"postCode": "4034",
+			"name": "Home"
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual, expect any
+
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal([]byte(`{
+		"aircons": {"ac1": {"info": {"name": "AC", "setTemp": 24.0, "uid": "0f038"}}},
+		"system": {
+			"deviceIds": [],
+			"deviceIdsV2": {},
+			"rid": "",
+			"latitude": 0,
+			"longitude": 0,
+			"postCode": "",
+			"name": "Home"
+		}
+	}`), &expect); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(actual, expect) {
+		t.Fatalf("unexpected output:\n%s", data)
+	}
+
+	for _, s := range []string{"abc", "Phone", "APHfgvBXznVqBL5l1QMsuyBCOns1", "27.3645676", "152.9806543", "4034"} {
+		if strings.Contains(string(data), s) {
+			t.Fatalf("output contains %q:\n%s", s, data)
+		}
+	}
+
+	if !strings.Contains(string(data), `"setTemp": 24.0`) {
+		t.Fatalf("output does not preserve the representation of numbers:\n%s", data)
+	}
+}
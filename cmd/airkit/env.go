@@ -1,7 +1,10 @@
 package main
 
 import (
+	"time"
+
 	"github.com/dogmatiq/ferrite"
+	"github.com/jmalloc/airkit/manager"
 	"github.com/jmalloc/airkit/myplace"
 )
 
@@ -28,11 +31,164 @@ var (
 		).
 		Required()
 
+	configFile = ferrite.
+			String(
+			"AIRKIT_CONFIG_FILE",
+			"the path to an optional YAML configuration file, which is reloaded when AirKit receives a SIGHUP signal",
+		).
+		Optional()
+
+	controlMode = ferrite.
+			Enum(
+			"AIRKIT_CONTROL_MODE",
+			"either 'automation' to have AirKit operate the unit based on each zone's HomeKit settings, or 'passthrough' to control the unit directly from HomeKit",
+		).
+		WithMembers(automationControlMode, passthroughControlMode).
+		WithDefault(automationControlMode).
+		Required()
+
+	controlStrategy = ferrite.
+			Enum(
+			"AIRKIT_CONTROL_STRATEGY",
+			"the algorithm used to decide when to heat and cool, either 'favour-cooling' or 'majority-demand'",
+		).
+		WithMembers(manager.FavourCoolingStrategy, manager.MajorityDemandStrategy).
+		WithDefault(manager.FavourCoolingStrategy).
+		Required()
+
+	coolStartThreshold = ferrite.
+				Float[float64](
+		"AIRKIT_COOL_START_THRESHOLD",
+		"the amount (in °C) by which a zone's temperature must exceed its target before it calls for cooling",
+	).
+		WithDefault(manager.DefaultThresholds.CoolStart).
+		Required()
+
+	coolStopThreshold = ferrite.
+				Float[float64](
+		"AIRKIT_COOL_STOP_THRESHOLD",
+		"the amount (in °C) by which a zone's temperature must fall below its target before it stops calling for cooling",
+	).
+		WithDefault(manager.DefaultThresholds.CoolStop).
+		Required()
+
+	heatStartThreshold = ferrite.
+				Float[float64](
+		"AIRKIT_HEAT_START_THRESHOLD",
+		"the amount (in °C) by which a zone's temperature must fall below its target before it calls for heating",
+	).
+		WithDefault(manager.DefaultThresholds.HeatStart).
+		Required()
+
+	heatStopThreshold = ferrite.
+				Float[float64](
+		"AIRKIT_HEAT_STOP_THRESHOLD",
+		"the amount (in °C) by which a zone's temperature must exceed its target before it stops calling for heating",
+	).
+		WithDefault(manager.DefaultThresholds.HeatStop).
+		Required()
+
+	minOnTime = ferrite.
+			Duration(
+			"AIRKIT_MIN_ON_TIME",
+			"the minimum duration that an air-conditioning unit must run before AirKit turns it off, such as '5m'",
+		).
+		WithMinimum(0).
+		WithDefault(5 * time.Minute).
+		Required()
+
+	minOffTime = ferrite.
+			Duration(
+			"AIRKIT_MIN_OFF_TIME",
+			"the minimum duration that an air-conditioning unit must be off before AirKit turns it on, such as '3m'",
+		).
+		WithMinimum(0).
+		WithDefault(3 * time.Minute).
+		Required()
+
+	minModeChangeInterval = ferrite.
+				Duration(
+			"AIRKIT_MIN_MODE_CHANGE_INTERVAL",
+			"the minimum duration after an air-conditioning unit was last heating or cooling before AirKit switches it to the opposite mode, such as '10m'",
+		).
+		WithMinimum(0).
+		WithDefault(10 * time.Minute).
+		Required()
+
+	damperControl = ferrite.
+			Enum(
+			"AIRKIT_DAMPER_CONTROL",
+			"either 'binary' to open the dampers of zones fully, or 'proportional' to open them in proportion to each zone's distance from its target temperature",
+		).
+		WithMembers(binaryDamperControl, proportionalDamperControl).
+		WithDefault(binaryDamperControl).
+		Required()
+
+	damperBand = ferrite.
+			Float[float64](
+		"AIRKIT_DAMPER_BAND",
+		"the distance (in °C) from a zone's target temperature at which its damper is opened fully, when using proportional damper control",
+	).
+		WithDefault(2).
+		Required()
+
+	damperMinPercentage = ferrite.
+				Signed[int](
+		"AIRKIT_DAMPER_MIN_PERCENTAGE",
+		"the smallest percentage by which an open zone's damper is opened, when using proportional damper control",
+	).
+		WithDefault(20).
+		Required()
+
+	zoneGroups = ferrite.
+			String(
+			"AIRKIT_ZONE_GROUPS",
+			"groups of zones that are presented as a single thermostat, such as 'Living Area=ac1/z01,ac1/z02:average;Bedrooms=ac1/z03,ac1/z04:max', the aggregate may be 'average', 'min' or 'max'",
+		).
+		Optional()
+
+	overrideDuration = ferrite.
+				Duration(
+			"AIRKIT_OVERRIDE_DURATION",
+			"the duration for which automation is paused after a change is made using the MyPlace app or wall panel, such as '1h', or '0' to disable override detection",
+		).
+		WithMinimum(0).
+		WithDefault(1 * time.Hour).
+		Required()
+
+	quietPeriod = ferrite.
+			Duration(
+			"AIRKIT_QUIET_PERIOD",
+			"the amount of time that a HomeKit setting must go unchanged before the change is applied, such as '500ms', or '0' to apply changes immediately",
+		).
+		WithMinimum(0).
+		WithDefault(manager.DefaultQuietPeriod).
+		Required()
+
 	homekitPIN = ferrite.
 			String(
 			"AIRKIT_HOMEKIT_PIN",
-			"the PIN code required to pair HomeKit with the AirKit hub",
+			"the PIN code required to pair HomeKit with the AirKit hub, overrides the randomly generated PIN",
 		).
-		WithDefault("12340000").
-		Required()
+		Optional()
+)
+
+const (
+	// automationControlMode is the AIRKIT_CONTROL_MODE value that enables
+	// AirKit's zone-driven automation.
+	automationControlMode = "automation"
+
+	// passthroughControlMode is the AIRKIT_CONTROL_MODE value that publishes a
+	// single thermostat that controls each unit directly.
+	passthroughControlMode = "passthrough"
+)
+
+const (
+	// binaryDamperControl is the AIRKIT_DAMPER_CONTROL value that opens the
+	// dampers of open zones fully.
+	binaryDamperControl = "binary"
+
+	// proportionalDamperControl is the AIRKIT_DAMPER_CONTROL value that opens
+	// the dampers of open zones in proportion to their distance from target.
+	proportionalDamperControl = "proportional"
 )
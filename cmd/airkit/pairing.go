@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brutella/hap"
+	"github.com/dogmatiq/imbue"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "pairing",
+		Short: "Manage the HomeKit controllers paired with AirKit.",
+		Long: `Manage the HomeKit controllers paired with AirKit.
+
+Changes made while 'airkit serve' is running take effect for new connections
+immediately, but the bridge's pairing status is not re-advertised until the
+server is restarted.`,
+	}
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the paired HomeKit controllers.",
+			Args:  cobra.NoArgs,
+			RunE: func(
+				cmd *cobra.Command,
+				args []string,
+			) error {
+				cmd.SilenceUsage = true
+
+				return imbue.Invoke1(
+					cmd.Context(),
+					container,
+					func(
+						ctx context.Context,
+						st hap.Store,
+					) error {
+						pairings, err := loadPairings(st)
+						if err != nil {
+							return err
+						}
+
+						if len(pairings) == 0 {
+							cmd.Println("no paired controllers")
+							return nil
+						}
+
+						for _, p := range pairings {
+							perm := "user"
+							if p.Permission == hap.PermissionAdmin {
+								perm = "admin"
+							}
+
+							cmd.Printf("%s  %s\n", p.Name, perm)
+						}
+
+						return nil
+					},
+				)
+			},
+		},
+		&cobra.Command{
+			Use:   "remove <id>",
+			Short: "Remove a paired HomeKit controller.",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(
+				cmd *cobra.Command,
+				args []string,
+			) error {
+				cmd.SilenceUsage = true
+
+				return imbue.Invoke1(
+					cmd.Context(),
+					container,
+					func(
+						ctx context.Context,
+						st hap.Store,
+					) error {
+						key := pairingKey(args[0])
+						if _, err := st.Get(key); err != nil {
+							return fmt.Errorf("there is no controller paired with ID %s", args[0])
+						}
+
+						if err := st.Delete(key); err != nil {
+							return err
+						}
+
+						cmd.Printf("removed pairing for %s\n", args[0])
+
+						return nil
+					},
+				)
+			},
+		},
+		&cobra.Command{
+			Use:   "reset",
+			Short: "Remove all paired HomeKit controllers.",
+			Args:  cobra.NoArgs,
+			RunE: func(
+				cmd *cobra.Command,
+				args []string,
+			) error {
+				cmd.SilenceUsage = true
+
+				return imbue.Invoke1(
+					cmd.Context(),
+					container,
+					func(
+						ctx context.Context,
+						st hap.Store,
+					) error {
+						pairings, err := loadPairings(st)
+						if err != nil {
+							return err
+						}
+
+						for _, p := range pairings {
+							if err := st.Delete(pairingKey(p.Name)); err != nil {
+								return err
+							}
+
+							cmd.Printf("removed pairing for %s\n", p.Name)
+						}
+
+						return nil
+					},
+				)
+			},
+		},
+		&cobra.Command{
+			Use:   "qr",
+			Short: "Print the HomeKit setup code and QR code for pairing a new controller.",
+			Args:  cobra.NoArgs,
+			RunE: func(
+				cmd *cobra.Command,
+				args []string,
+			) error {
+				cmd.SilenceUsage = true
+
+				return imbue.Invoke1(
+					cmd.Context(),
+					container,
+					func(
+						ctx context.Context,
+						st hap.Store,
+					) error {
+						pin, setupID, err := loadSetupCode(st)
+						if err != nil {
+							return err
+						}
+
+						return printSetupCode(cmd, pin, setupID)
+					},
+				)
+			},
+		},
+	)
+
+	root.AddCommand(cmd)
+}
+
+// pairingSuffix is the suffix of the keys used by the HAP library to persist
+// pairings in the store.
+const pairingSuffix = ".pairing"
+
+// pairingKey returns the key used by the HAP library to persist the pairing
+// with the controller with the given ID.
+func pairingKey(id string) string {
+	return hex.EncodeToString([]byte(id)) + pairingSuffix
+}
+
+// loadPairings returns the pairings persisted in the store, sorted by
+// controller ID.
+func loadPairings(st hap.Store) ([]hap.Pairing, error) {
+	keys, err := st.KeysWithSuffix(pairingSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairings []hap.Pairing
+
+	for _, k := range keys {
+		data, err := st.Get(k)
+		if err != nil {
+			return nil, err
+		}
+
+		var p hap.Pairing
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("unable to parse pairing %s: %w", strings.TrimSuffix(k, pairingSuffix), err)
+		}
+
+		pairings = append(pairings, p)
+	}
+
+	sort.Slice(
+		pairings,
+		func(i, j int) bool {
+			return pairings[i].Name < pairings[j].Name
+		},
+	)
+
+	return pairings, nil
+}
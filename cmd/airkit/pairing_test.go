@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/brutella/hap"
+)
+
+func TestPairingKey(t *testing.T) {
+	cases := []struct {
+		ID     string
+		Expect string
+	}{
+		{"ABC", "414243.pairing"},
+		{"4C3B1A2E-1234", "34433342314132452d31323334.pairing"},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.ID, func(t *testing.T) {
+			if actual := pairingKey(c.ID); actual != c.Expect {
+				t.Fatalf("unexpected key: got %s, want %s", actual, c.Expect)
+			}
+		})
+	}
+}
+
+func TestLoadPairings(t *testing.T) {
+	st := hap.NewMemStore()
+
+	// Persist the pairings the same way as the HAP library, along with some
+	// other values that are not pairings.
+	for _, p := range []hap.Pairing{
+		{Name: "controller-b", Permission: hap.PermissionUser},
+		{Name: "controller-a", Permission: hap.PermissionAdmin},
+	} {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := st.Set(pairingKey(p.Name), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := st.Set("uuid", []byte("XX:XX:XX:XX:XX:XX")); err != nil {
+		t.Fatal(err)
+	}
+
+	pairings, err := loadPairings(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pairings) != 2 ||
+		pairings[0].Name != "controller-a" || pairings[0].Permission != hap.PermissionAdmin ||
+		pairings[1].Name != "controller-b" || pairings[1].Permission != hap.PermissionUser {
+		t.Fatalf("unexpected pairings: %+v", pairings)
+	}
+
+	t.Run("it removes only the pairing with the given ID", func(t *testing.T) {
+		if err := st.Delete(pairingKey("controller-a")); err != nil {
+			t.Fatal(err)
+		}
+
+		pairings, err := loadPairings(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(pairings) != 1 || pairings[0].Name != "controller-b" {
+			t.Fatalf("unexpected pairings: %+v", pairings)
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+
+	"github.com/jmalloc/airkit/recording"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "record <file>",
+		Short: "Run the HomeKit accessory server, recording system state and commands to a file.",
+		Long: `Run the HomeKit accessory server, recording system state and commands to a file.
+
+Each poll of the MyPlace system state and each batch of commands sent to the
+MyPlace API is appended to the file as a single line of JSON. The recording can
+be replayed using 'airkit replay'.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(
+			cmd *cobra.Command,
+			args []string,
+		) error {
+			f, err := os.OpenFile(
+				args[0],
+				os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+				0644,
+			)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return runServer(cmd, recording.NewWriter(f))
+		},
+	}
+
+	cmd.Flags().BoolP("verbose", "v", false, "Enable verbose bonjour logging")
+	cmd.Flags().Bool("dry-run", false, "Apply commands to an in-memory copy of the system state instead of sending them to the MyPlace API")
+
+	root.AddCommand(cmd)
+}
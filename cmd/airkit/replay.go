@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/jmalloc/airkit/manager"
+	"github.com/jmalloc/airkit/myplace"
+	"github.com/jmalloc/airkit/recording"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "replay <file>",
+		Short: "Replay a recording produced by 'airkit record' against the accessory managers.",
+		Long: `Replay a recording produced by 'airkit record' against the accessory managers.
+
+Each system state snapshot in the recording is fed to the accessory managers, as
+though it had been read from the MyPlace API. The commands that the managers
+would send are printed alongside the commands that were sent when the recording
+was made.
+
+The managers observe the time at which each snapshot was recorded, regardless
+of the replay speed.
+
+HomeKit settings, such as each zone's heating/cooling mode, are not part of the
+recording. Use --db to load them from a copy of an AirKit database.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(
+			cmd *cobra.Command,
+			args []string,
+		) error {
+			speed, err := cmd.Flags().GetFloat64("speed")
+			if err != nil {
+				return err
+			}
+
+			db, err := cmd.Flags().GetString("db")
+			if err != nil {
+				return err
+			}
+
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			cmd.SilenceUsage = true
+
+			st := &replayStore{Store: hap.NewMemStore()}
+			if db != "" {
+				st.base = hap.NewFsStore(db)
+			}
+
+			return replay(cmd, recording.NewReader(f), st, speed)
+		},
+	}
+
+	cmd.Flags().Float64("speed", 1, "The replay speed relative to real time, or 0 to replay as fast as possible")
+	cmd.Flags().String("db", "", "The path to an AirKit database from which to load HomeKit settings, it is not modified")
+
+	root.AddCommand(cmd)
+}
+
+// replay feeds the system state snapshots in r to a new set of accessory
+// managers.
+func replay(
+	cmd *cobra.Command,
+	r *recording.Reader,
+	st hap.Store,
+	speed float64,
+) error {
+	ctx := cmd.Context()
+	commands := make(chan []myplace.Command, 100)
+
+	var (
+		managers []manager.AccessoryManager
+		now      time.Time
+	)
+
+	config, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	config.AirCon.Now = func() time.Time {
+		return now
+	}
+
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if speed > 0 && !now.IsZero() {
+			d := time.Duration(
+				float64(e.Time.Sub(now)) / speed,
+			)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(d):
+			}
+		}
+
+		now = e.Time
+
+		if !e.IsSystem() {
+			for _, c := range e.Commands {
+				cmd.Printf("%s  recorded  %s\n", now.Format(time.RFC3339), c)
+			}
+			continue
+		}
+
+		s, err := myplace.ParseSystem(e.System)
+		if err != nil {
+			return err
+		}
+
+		if managers == nil {
+			managers, err = newManagers(st, commands, s, config)
+			if err != nil {
+				return err
+			}
+
+			for _, m := range managers {
+				go m.Run(ctx)
+			}
+		}
+
+		for _, m := range managers {
+			m.Update(s)
+
+			if err := m.Sync(ctx); err != nil {
+				return err
+			}
+		}
+
+		for len(commands) != 0 {
+			for _, c := range <-commands {
+				cmd.Printf("%s  replayed  %s\n", now.Format(time.RFC3339), c)
+			}
+		}
+	}
+}
+
+// replayStore is a hap.Store that reads values from an existing AirKit
+// database without modifying it.
+type replayStore struct {
+	hap.Store
+	base hap.Store
+}
+
+func (s *replayStore) Get(key string) ([]byte, error) {
+	v, err := s.Store.Get(key)
+	if err != nil && s.base != nil {
+		return s.base.Get(key)
+	}
+
+	return v, err
+}
+
+func (s *replayStore) KeysWithSuffix(suffix string) ([]string, error) {
+	keys, err := s.Store.KeysWithSuffix(suffix)
+	if err != nil || s.base == nil {
+		return keys, err
+	}
+
+	base, err := s.base.KeysWithSuffix(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range base {
+		if _, err := s.Store.Get(k); err != nil {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,6 +18,8 @@ import (
 	"github.com/dogmatiq/imbue"
 	"github.com/jmalloc/airkit/manager"
 	"github.com/jmalloc/airkit/myplace"
+	"github.com/jmalloc/airkit/reconciler"
+	"github.com/jmalloc/airkit/recording"
 	"github.com/spf13/cobra"
 )
 
@@ -25,111 +31,647 @@ func init() {
 			cmd *cobra.Command,
 			args []string,
 		) error {
-			verbose, err := cmd.Flags().GetBool("verbose")
+			return runServer(cmd, nil)
+		},
+	}
+
+	cmd.Flags().BoolP("verbose", "v", false, "Enable verbose bonjour logging")
+	cmd.Flags().Bool("dry-run", false, "Apply commands to an in-memory copy of the system state instead of sending them to the MyPlace API")
+
+	root.AddCommand(cmd)
+}
+
+// runServer runs the HomeKit accessory server until the command's context is
+// canceled.
+//
+// If rec is non-nil, each poll of the system state and each batch of commands
+// sent to the MyPlace API is written to the recording.
+func runServer(cmd *cobra.Command, rec *recording.Writer) error {
+	verbose, err := cmd.Flags().GetBool("verbose")
+	if err != nil {
+		return err
+	}
+	if verbose {
+		dnslog.Debug.Enable()
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	ctx, cancel := signal.NotifyContext(
+		cmd.Context(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer cancel()
+
+	config, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	return imbue.Invoke2(
+		ctx,
+		container,
+		func(
+			ctx context.Context,
+			st hap.Store,
+			cli *myplace.Client,
+		) error {
+			pin, setupID, err := loadSetupCode(st)
 			if err != nil {
 				return err
 			}
-			if verbose {
-				dnslog.Debug.Enable()
+
+			if err := printSetupCode(cmd, pin, setupID); err != nil {
+				return err
 			}
 
-			cmd.SilenceUsage = true
+			// The dry-run client is shared by each instance of the server, so
+			// that the in-memory changes survive the accessories being
+			// rebuilt.
+			var client reconciler.Client = cli
+			if dryRun {
+				log.Print("dry run enabled, commands will not be sent to the MyPlace API")
+				client = &dryRunClient{Client: cli}
+			}
 
-			ctx, cancel := signal.NotifyContext(
-				cmd.Context(),
-				os.Interrupt,
-				syscall.SIGTERM,
-			)
-			defer cancel()
-
-			return imbue.Invoke2(
-				ctx,
-				container,
-				func(
-					ctx context.Context,
-					st hap.Store,
-					cli *myplace.Client,
-				) error {
-					sys, err := readInitialState(ctx, cmd, cli)
-					if err != nil {
-						return err
-					}
+			// known is the system that the current accessories were built
+			// from, and seen records when each of its units and zones was
+			// last reported by the MyPlace system.
+			var known *myplace.System
+			seen := &presence{}
 
-					bridge := manager.NewBridge(version, sys)
-					commands := make(chan []myplace.Command, 100)
-					var managers []manager.AccessoryManager
-
-					for _, ac := range sys.AirCons {
-						log.Printf("adding HomeKit accessory for the '%s' air-conditioner\n", ac.Details.Name)
-						managers = append(
-							managers,
-							manager.NewAirConManager(st, commands, ac),
-						)
-
-						managers = append(
-							managers,
-							manager.NewFanManager(commands, ac),
-						)
+			for {
+				sys, err := readInitialState(ctx, cmd, client)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
 					}
+					return err
+				}
 
-					var accessories []*accessory.A
-					for _, m := range managers {
-						accessories = append(accessories, m.Accessories()...)
-					}
+				seen.observe(sys, time.Now())
+
+				if known != nil {
+					retainMissingZones(sys, known, seen, time.Now())
+				}
+				known = sys
+
+				for _, ref := range config.unknownZones(sys) {
+					log.Printf("the configuration refers to the '%s' zone, which is not reported by the MyPlace system", ref)
+				}
 
-					srv, err := hap.NewServer(st, bridge.A, accessories...)
-					srv.Pin = homekitPIN.Value()
-					if err != nil {
+				srvCtx, cancelSrv := context.WithCancel(ctx)
+				done := make(chan error, 1)
+				changed := make(chan struct{}, 1)
+
+				go func() {
+					done <- serveAccessories(srvCtx, st, client, rec, config, pin, setupID, sys, seen, changed)
+				}()
+
+			wait:
+				for {
+					select {
+					case err := <-done:
+						cancelSrv()
 						return err
-					}
 
-					go func() {
-						for {
-							select {
-							case <-ctx.Done():
-								return
-
-							case cmds := <-commands:
-								for _, cmd := range cmds {
-									log.Print(cmd)
-								}
-
-								err := cli.Write(ctx, cmds...)
-								if err != nil {
-									log.Print(err)
-									continue
-								}
-
-							case <-time.After(2 * time.Second):
-								s, err := cli.Read(ctx)
-								if err != nil {
-									log.Print(err)
-									continue
-								}
-
-								for _, m := range managers {
-									m.Update(s)
-								}
-							}
+					case <-hup:
+						log.Print("reloading configuration")
+
+						c, err := loadServerConfig()
+						if err != nil {
+							log.Printf("unable to reload configuration, continuing with the existing configuration: %s", err)
+							continue
 						}
-					}()
 
-					log.Printf("starting HomeKit accessory server, PIN is %s", srv.Pin)
+						config = c
+						cancelSrv()
 
-					err = srv.ListenAndServe(ctx)
-					if ctx.Err() != nil {
-						return nil
+						if err := <-done; err != nil {
+							return err
+						}
+
+						break wait
+
+					case <-changed:
+						log.Print("the MyPlace zones have changed, rebuilding accessories")
+						cancelSrv()
+
+						if err := <-done; err != nil {
+							return err
+						}
+
+						break wait
 					}
+				}
+			}
+		},
+	)
+}
 
-					return err
-				},
-			)
+// serveAccessories runs the HomeKit accessory server for the accessories built
+// from sys, using the given configuration until ctx is canceled.
+//
+// The accessories are rebuilt each time it is called. Their IDs are stable, so
+// existing HomeKit pairings, rooms and automations remain valid. The server
+// must be restarted to add accessories, as the hap.Server only accepts them
+// when it is created, which is also the only time it increments the
+// configuration number that tells HomeKit to fetch the accessories again.
+//
+// A value is sent to changed once air-conditioning units or zones have been
+// added, renamed or removed for at least topologyChangeDelay, compared to those
+// that the accessories were built from. seen is updated with the units and
+// zones reported by each read.
+func serveAccessories(
+	ctx context.Context,
+	st hap.Store,
+	cli reconciler.Client,
+	rec *recording.Writer,
+	config serverConfig,
+	pin, setupID string,
+	sys *myplace.System,
+	seen *presence,
+	changed chan<- struct{},
+) error {
+	bridge := manager.NewBridge(version, sys)
+	commands := make(chan []myplace.Command, 100)
+
+	r := &reconciler.Reconciler{
+		Client:       cli,
+		Commands:     commands,
+		PollInterval: config.PollInterval,
+		StaleAfter:   config.StaleAfter,
+	}
+
+	config.AirCon.Refresh = r.Refresh
+
+	managers, err := newManagers(st, commands, sys, config)
+	if err != nil {
+		return err
+	}
+
+	var accessories []*accessory.A
+	for _, m := range managers {
+		accessories = append(accessories, m.Accessories()...)
+	}
+
+	srv, err := hap.NewServer(st, bridge.A, accessories...)
+	if err != nil {
+		return err
+	}
+
+	srv.Pin = pin
+	srv.SetupId = setupID
+
+	if err := manager.SerializeRequests(srv, managers); err != nil {
+		return err
+	}
+
+	built := newTopology(sys)
+	var changedAt time.Time
+
+	r.OnRead = func(data []byte, s *myplace.System) {
+		if rec != nil {
+			if err := rec.WriteSystem(time.Now(), data); err != nil {
+				log.Print(err)
+			}
+		}
+
+		// The managers handle any units or zones that they don't know about,
+		// so they are updated even if the accessories need to be rebuilt.
+		for _, m := range managers {
+			m.Update(s)
+		}
+
+		now := time.Now()
+		seen.observe(s, now)
+
+		// Restarting the server disconnects HomeKit, so don't react to new or
+		// renamed zones until every poll has reported them for a while, in
+		// case the panel is returning inconsistent data. Likewise, zones are
+		// only removed once no poll has reported them for a while.
+		isChanged := false
+		if built.covers(s) {
+			changedAt = time.Time{}
+		} else if changedAt.IsZero() {
+			changedAt = now
+		} else if now.Sub(changedAt) >= topologyChangeDelay {
+			isChanged = true
+		}
+
+		if isChanged || seen.isAnyGone(built, now) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	r.OnWrite = func(cmds []myplace.Command) {
+		for _, cmd := range cmds {
+			log.Print(cmd)
+		}
+
+		if rec != nil {
+			if err := rec.WriteCommands(time.Now(), cmds...); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
+	r.OnStale = func(unitID string, isStale bool) {
+		for _, m := range managers {
+			m.SetStale(unitID, isStale)
+		}
+	}
+
+	r.OnWriteFailed = func(unitID string, _ error) {
+		for _, m := range managers {
+			m.WriteFailed(unitID)
+		}
+	}
+
+	for _, m := range managers {
+		go m.Run(ctx)
+	}
+
+	go r.Run(ctx)
+
+	log.Print("starting HomeKit accessory server")
+
+	err = srv.ListenAndServe(ctx)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// newAirConConfig returns the configuration for each AirConManager, based on
+// the environment.
+func newAirConConfig() (manager.AirConConfig, error) {
+	strategy, err := manager.NewControlStrategy(controlStrategy.Value())
+	if err != nil {
+		return manager.AirConConfig{}, err
+	}
+
+	thresholds := manager.Thresholds{
+		CoolStart: coolStartThreshold.Value(),
+		CoolStop:  coolStopThreshold.Value(),
+		HeatStart: heatStartThreshold.Value(),
+		HeatStop:  heatStopThreshold.Value(),
+	}
+
+	if err := thresholds.Validate(); err != nil {
+		return manager.AirConConfig{}, fmt.Errorf("the temperature thresholds are invalid: %w", err)
+	}
+
+	config := manager.AirConConfig{
+		Strategy:   strategy,
+		Thresholds: &thresholds,
+		Protection: manager.CompressorProtection{
+			MinOnTime:             minOnTime.Value(),
+			MinOffTime:            minOffTime.Value(),
+			MinModeChangeInterval: minModeChangeInterval.Value(),
 		},
+		OverrideDuration: overrideDuration.Value(),
+		QuietPeriod:      quietPeriod.Value(),
 	}
 
-	cmd.Flags().BoolP("verbose", "v", false, "Enable verbose bonjour logging")
+	if damperControl.Value() == proportionalDamperControl {
+		dm := manager.DamperModulation{
+			Band:          damperBand.Value(),
+			MinPercentage: damperMinPercentage.Value(),
+		}
 
-	root.AddCommand(cmd)
+		if err := dm.Validate(); err != nil {
+			return manager.AirConConfig{}, fmt.Errorf("the damper settings are invalid: %w", err)
+		}
+
+		config.DamperModulation = &dm
+	}
+
+	return config, nil
+}
+
+// parseZoneGroups parses a list of zone groups in the format used by
+// AIRKIT_ZONE_GROUPS, keyed by the ID of the air-conditioning unit that their
+// zones belong to.
+func parseZoneGroups(v string) (map[string][]manager.ZoneGroup, error) {
+	groups := map[string][]manager.ZoneGroup{}
+
+	for _, def := range strings.Split(v, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		name, members, ok := strings.Cut(def, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <name>=<zone>,<zone>[:<aggregate>], got '%s'", def)
+		}
+
+		members, aggregate, _ := strings.Cut(members, ":")
+
+		if err := addZoneGroup(
+			groups,
+			strings.TrimSpace(name),
+			strings.Split(members, ","),
+			strings.TrimSpace(aggregate),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, validateZoneGroups(groups)
+}
+
+// addZoneGroup adds a group with the given name, zone references and aggregate
+// to groups, under the ID of the air-conditioning unit that its zones belong
+// to.
+func addZoneGroup(
+	groups map[string][]manager.ZoneGroup,
+	name string,
+	refs []string,
+	aggregate string,
+) error {
+	g := manager.ZoneGroup{
+		Name:      name,
+		Aggregate: manager.TempAggregate(aggregate),
+	}
+
+	var unitID string
+
+	for _, ref := range refs {
+		u, zoneID, err := parseZoneRef(ref)
+		if err != nil {
+			return fmt.Errorf("the '%s' zone group is invalid: %w", name, err)
+		}
+
+		if unitID != "" && u != unitID {
+			return fmt.Errorf("the '%s' zone group has zones of more than one air-conditioning unit", name)
+		}
+
+		unitID = u
+		g.Zones = append(g.Zones, zoneID)
+	}
+
+	groups[unitID] = append(groups[unitID], g)
+
+	return nil
+}
+
+// validateZoneGroups returns an error if any of the given groups is invalid,
+// or if a zone is a member of more than one group.
+func validateZoneGroups(groups map[string][]manager.ZoneGroup) error {
+	unitIDs := make([]string, 0, len(groups))
+	for id := range groups {
+		unitIDs = append(unitIDs, id)
+	}
+	sort.Strings(unitIDs)
+
+	for _, unitID := range unitIDs {
+		seen := map[string]string{}
+
+		for _, g := range groups[unitID] {
+			if err := g.Validate(); err != nil {
+				return err
+			}
+
+			for _, id := range g.Zones {
+				if other, ok := seen[id]; ok {
+					return fmt.Errorf("the %s/%s zone is in both the '%s' and '%s' groups", unitID, id, other, g.Name)
+				}
+				seen[id] = g.Name
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseZoneRef parses a reference to a zone of a specific air-conditioning
+// unit, such as "ac1/z01".
+func parseZoneRef(ref string) (unitID, zoneID string, err error) {
+	ref = strings.TrimSpace(ref)
+
+	unitID, zoneID, ok := strings.Cut(ref, "/")
+	if !ok || unitID == "" || zoneID == "" || strings.Contains(zoneID, "/") {
+		return "", "", fmt.Errorf("expected a zone in the form <unit>/<zone>, such as ac1/z01, got '%s'", ref)
+	}
+
+	return unitID, zoneID, nil
+}
+
+// newManagers returns the accessory managers for each of the air-conditioning
+// units in the given system.
+func newManagers(
+	st hap.Store,
+	commands chan<- []myplace.Command,
+	sys *myplace.System,
+	config serverConfig,
+) ([]manager.AccessoryManager, error) {
+	settings, err := manager.NewSettings(st)
+	if err != nil {
+		return nil, err
+	}
+
+	var managers []manager.AccessoryManager
+
+	for _, ac := range sys.AirCons {
+		log.Printf("adding HomeKit accessory for the '%s' air-conditioner\n", ac.Details.Name)
+
+		if config.EnableThermostats {
+			switch config.ControlMode {
+			case automationControlMode:
+				managers = append(
+					managers,
+					manager.NewAirConManager(settings, commands, ac, config.airConConfig(ac.ID)),
+				)
+			case passthroughControlMode:
+				managers = append(
+					managers,
+					manager.NewPassthroughManager(settings, commands, ac, config.Zones[ac.ID], config.AirCon.QuietPeriod),
+				)
+			}
+		}
+
+		if config.EnableFan {
+			managers = append(
+				managers,
+				manager.NewFanManager(settings, commands, ac, config.AirCon.QuietPeriod),
+			)
+		}
+	}
+
+	return managers, nil
+}
+
+// topologyChangeDelay is the amount of time that air-conditioning units or
+// zones must be reported as added or renamed, or not reported at all, before
+// the accessories are rebuilt.
+const topologyChangeDelay = 5 * time.Minute
+
+// topology describes the air-conditioning units and zones that accessories are
+// built for.
+//
+// It maps each unit ID, and each zone ID qualified by its unit ID, to a
+// description that changes whenever the accessories would need to be rebuilt.
+type topology map[string]string
+
+// newTopology returns the topology of the given system.
+func newTopology(sys *myplace.System) topology {
+	t := topology{}
+
+	for _, ac := range sys.AirCons {
+		t[ac.ID] = fmt.Sprintf("%d:%q", ac.Number, ac.Details.Name)
+
+		for _, z := range ac.Zones {
+			t[ac.ID+"/"+z.ID] = fmt.Sprintf("%d:%q", z.Number, z.Name)
+		}
+	}
+
+	return t
+}
+
+// covers returns true if every unit and zone in sys is in t, with the same
+// number and name.
+//
+// Units and zones that are missing from sys are not considered a change, as the
+// MyPlace system sometimes omits zones that are still installed.
+func (t topology) covers(sys *myplace.System) bool {
+	for k, v := range newTopology(sys) {
+		if x, ok := t[k]; !ok || x != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// presence records when each air-conditioning unit and zone was last reported
+// by the MyPlace system, keyed in the same way as topology.
+type presence struct {
+	m      sync.Mutex
+	seenAt map[string]time.Time
+}
+
+// observe records that the units and zones in sys were reported at the given
+// time.
+func (p *presence) observe(sys *myplace.System, at time.Time) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.seenAt == nil {
+		p.seenAt = map[string]time.Time{}
+	}
+
+	for k := range newTopology(sys) {
+		p.seenAt[k] = at
+	}
+}
+
+// isGone returns true if the unit or zone with the given topology key has not
+// been reported for at least topologyChangeDelay.
+func (p *presence) isGone(key string, now time.Time) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	at, ok := p.seenAt[key]
+	return ok && now.Sub(at) >= topologyChangeDelay
+}
+
+// isAnyGone returns true if any of the units or zones in t are gone.
+func (p *presence) isAnyGone(t topology, now time.Time) bool {
+	for k := range t {
+		if p.isGone(k, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retainMissingZones adds the air-conditioning units and zones in known that
+// are missing from sys to sys, so that their accessories are not removed from
+// HomeKit when the MyPlace system omits them.
+//
+// A unit or zone is not retained once it is gone according to seen, as it has
+// most likely been removed. A zone is not retained if its zone number is now
+// used by another zone.
+func retainMissingZones(sys, known *myplace.System, seen *presence, now time.Time) {
+	if sys.AirConByID == nil {
+		sys.AirConByID = map[string]*myplace.AirCon{}
+	}
+
+	for _, k := range known.AirCons {
+		ac, ok := sys.AirConByID[k.ID]
+		if !ok {
+			if seen.isGone(k.ID, now) {
+				log.Printf("the '%s' air-conditioner has not been reported for %s, removing its accessories", k.Details.Name, topologyChangeDelay)
+				continue
+			}
+
+			c := *k
+			c.Zones = nil
+			c.ZoneByID = nil
+
+			ac = &c
+			sys.AirConByID[ac.ID] = ac
+			sys.AirCons = append(sys.AirCons, ac)
+		}
+
+		for _, kz := range k.Zones {
+			if _, ok := ac.ZoneByID[kz.ID]; ok {
+				continue
+			}
+
+			if seen.isGone(k.ID+"/"+kz.ID, now) {
+				log.Printf("the '%s' zone has not been reported for %s, removing its accessories", kz.Name, topologyChangeDelay)
+				continue
+			}
+
+			if _, ok := ac.ZoneByNumber(kz.Number); ok {
+				continue
+			}
+
+			if ac.ZoneByID == nil {
+				ac.ZoneByID = map[string]*myplace.Zone{}
+			}
+
+			z := *kz
+			ac.ZoneByID[z.ID] = &z
+			ac.Zones = append(ac.Zones, &z)
+		}
+
+		sort.Slice(ac.Zones, func(i, j int) bool {
+			return ac.Zones[i].Number < ac.Zones[j].Number
+		})
+	}
+
+	sort.Slice(sys.AirCons, func(i, j int) bool {
+		return sys.AirCons[i].ID < sys.AirCons[j].ID
+	})
+}
+
+// readSystem reads and parses the state of the MyPlace system.
+func readSystem(ctx context.Context, cli reconciler.Client) (*myplace.System, error) {
+	data, err := cli.ReadRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return myplace.ParseSystem(data)
 }
 
 // readInitialState reads the state of the MyPlace system.
@@ -138,12 +680,12 @@ func init() {
 func readInitialState(
 	ctx context.Context,
 	cmd *cobra.Command,
-	cli *myplace.Client,
+	cli reconciler.Client,
 ) (*myplace.System, error) {
 	for {
 		log.Print("reading MyPlace system information")
 
-		sys, err := cli.Read(ctx)
+		sys, err := readSystem(ctx, cli)
 		if err == nil || err == context.Canceled {
 			return sys, err
 		}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmalloc/airkit/manager"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestTopology_covers(t *testing.T) {
+	built := newTopology(parse(t, `{
+		"aircons": {
+			"ac1": {
+				"info": {"name": "AC"},
+				"zones": {
+					"z01": {"number": 1, "name": "Living"},
+					"z02": {"number": 2, "name": "Kitchen"},
+					"z03": {"number": 3, "name": "Office"}
+				}
+			}
+		}
+	}`))
+
+	cases := []struct {
+		Name   string
+		System string
+		Expect bool
+	}{
+		{
+			"unchanged",
+			`{"aircons": {"ac1": {"info": {"name": "AC"}, "zones": {
+				"z01": {"number": 1, "name": "Living"},
+				"z02": {"number": 2, "name": "Kitchen"},
+				"z03": {"number": 3, "name": "Office"}
+			}}}}`,
+			true,
+		},
+		{
+			"missing zone",
+			`{"aircons": {"ac1": {"info": {"name": "AC"}, "zones": {
+				"z01": {"number": 1, "name": "Living"},
+				"z03": {"number": 3, "name": "Office"}
+			}}}}`,
+			true,
+		},
+		{
+			"missing unit",
+			`{"aircons": {}}`,
+			true,
+		},
+		{
+			"added zone",
+			`{"aircons": {"ac1": {"info": {"name": "AC"}, "zones": {
+				"z01": {"number": 1, "name": "Living"},
+				"z02": {"number": 2, "name": "Kitchen"},
+				"z03": {"number": 3, "name": "Office"},
+				"z04": {"number": 4, "name": "Bedroom"}
+			}}}}`,
+			false,
+		},
+		{
+			"renamed zone",
+			`{"aircons": {"ac1": {"info": {"name": "AC"}, "zones": {
+				"z01": {"number": 1, "name": "Lounge"},
+				"z02": {"number": 2, "name": "Kitchen"},
+				"z03": {"number": 3, "name": "Office"}
+			}}}}`,
+			false,
+		},
+		{
+			"added unit",
+			`{"aircons": {
+				"ac1": {"info": {"name": "AC"}, "zones": {
+					"z01": {"number": 1, "name": "Living"}
+				}},
+				"ac2": {"info": {"name": "Upstairs"}, "zones": {
+					"z01": {"number": 1, "name": "Bedroom"}
+				}}
+			}}`,
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			if actual := built.covers(parse(t, c.System)); actual != c.Expect {
+				t.Fatalf("unexpected result: got %t, want %t", actual, c.Expect)
+			}
+		})
+	}
+}
+
+func TestRetainMissingZones(t *testing.T) {
+	const knownData = `{"aircons": {
+		"ac1": {"info": {"name": "AC"}, "zones": {
+			"z01": {"number": 1, "name": "Living"},
+			"z02": {"number": 2, "name": "Kitchen"},
+			"z03": {"number": 3, "name": "Office"}
+		}},
+		"ac2": {"info": {"name": "Upstairs"}, "zones": {
+			"z01": {"number": 1, "name": "Bedroom"}
+		}}
+	}}`
+
+	const sysData = `{"aircons": {
+		"ac1": {"info": {"name": "AC"}, "zones": {
+			"z01": {"number": 1, "name": "Living"},
+			"z03": {"number": 3, "name": "Office"},
+			"z04": {"number": 4, "name": "Bedroom"}
+		}}
+	}}`
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("it retains missing units and zones", func(t *testing.T) {
+		known := parse(t, knownData)
+		sys := parse(t, sysData)
+
+		seen := &presence{}
+		seen.observe(known, start)
+
+		now := start.Add(topologyChangeDelay - time.Second)
+		seen.observe(sys, now)
+		retainMissingZones(sys, known, seen, now)
+
+		expect := newTopology(parse(t, `{"aircons": {
+			"ac1": {"info": {"name": "AC"}, "zones": {
+				"z01": {"number": 1, "name": "Living"},
+				"z02": {"number": 2, "name": "Kitchen"},
+				"z03": {"number": 3, "name": "Office"},
+				"z04": {"number": 4, "name": "Bedroom"}
+			}},
+			"ac2": {"info": {"name": "Upstairs"}, "zones": {
+				"z01": {"number": 1, "name": "Bedroom"}
+			}}
+		}}`))
+
+		if actual := newTopology(sys); !reflect.DeepEqual(actual, expect) {
+			t.Fatalf("unexpected topology: got %v, want %v", actual, expect)
+		}
+
+		var ids []string
+		for _, z := range sys.AirConByID["ac1"].Zones {
+			ids = append(ids, z.ID)
+		}
+
+		if expect := []string{"z01", "z02", "z03", "z04"}; !reflect.DeepEqual(ids, expect) {
+			t.Fatalf("unexpected zone order: got %v, want %v", ids, expect)
+		}
+	})
+
+	t.Run("it drops units and zones that have been missing for the topology change delay", func(t *testing.T) {
+		known := parse(t, knownData)
+		sys := parse(t, sysData)
+
+		seen := &presence{}
+		seen.observe(known, start)
+
+		now := start.Add(topologyChangeDelay)
+		seen.observe(sys, now)
+
+		if !seen.isAnyGone(newTopology(known), now) {
+			t.Fatal("expected the missing units and zones to be gone")
+		}
+
+		retainMissingZones(sys, known, seen, now)
+
+		expect := newTopology(parse(t, sysData))
+
+		if actual := newTopology(sys); !reflect.DeepEqual(actual, expect) {
+			t.Fatalf("unexpected topology: got %v, want %v", actual, expect)
+		}
+	})
+}
+
+func TestParseZoneGroups(t *testing.T) {
+	t.Run("it parses the groups of each unit", func(t *testing.T) {
+		groups, err := parseZoneGroups(
+			" Living Area = ac1/z01, ac1/z02 : average ;Bedrooms=ac1/z03,ac1/z04:max;Upstairs=ac2/z01,ac2/z02;",
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := map[string][]manager.ZoneGroup{
+			"ac1": {
+				{Name: "Living Area", Zones: []string{"z01", "z02"}, Aggregate: manager.AverageTemp},
+				{Name: "Bedrooms", Zones: []string{"z03", "z04"}, Aggregate: manager.MaxTemp},
+			},
+			"ac2": {
+				{Name: "Upstairs", Zones: []string{"z01", "z02"}},
+			},
+		}
+
+		if !reflect.DeepEqual(groups, expect) {
+			t.Fatalf("unexpected groups: got %v, want %v", groups, expect)
+		}
+	})
+
+	t.Run("it accepts an empty value", func(t *testing.T) {
+		groups, err := parseZoneGroups(" ; ")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(groups) != 0 {
+			t.Fatalf("unexpected groups: %v", groups)
+		}
+	})
+
+	cases := []struct {
+		Name   string
+		Value  string
+		Expect string
+	}{
+		{
+			"missing zones",
+			"Living Area",
+			"expected <name>=<zone>,<zone>[:<aggregate>], got 'Living Area'",
+		},
+		{
+			"missing unit",
+			"Living Area=z01,z02",
+			"the 'Living Area' zone group is invalid: expected a zone in the form <unit>/<zone>, such as ac1/z01, got 'z01'",
+		},
+		{
+			"malformed zone",
+			"Living Area=ac1/z01,ac1/z02/z03",
+			"the 'Living Area' zone group is invalid: expected a zone in the form <unit>/<zone>, such as ac1/z01, got 'ac1/z02/z03'",
+		},
+		{
+			"zones of several units",
+			"Living Area=ac1/z01,ac2/z02",
+			"the 'Living Area' zone group has zones of more than one air-conditioning unit",
+		},
+		{
+			"missing name",
+			"=ac1/z01,ac1/z02",
+			"the zone group must have a name",
+		},
+		{
+			"single zone",
+			"Living Area=ac1/z01",
+			"the 'Living Area' zone group must have at least two zones",
+		},
+		{
+			"unknown aggregate",
+			"Living Area=ac1/z01,ac1/z02:median",
+			"the 'Living Area' zone group has an unknown aggregate (median), expected average, min or max",
+		},
+		{
+			"zone in several groups",
+			"Living Area=ac1/z01,ac1/z02;Kitchen=ac1/z02,ac1/z03",
+			"the ac1/z02 zone is in both the 'Living Area' and 'Kitchen' groups",
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run("it rejects "+c.Name, func(t *testing.T) {
+			_, err := parseZoneGroups(c.Value)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if err.Error() != c.Expect {
+				t.Fatalf("unexpected error: got %q, want %q", err, c.Expect)
+			}
+		})
+	}
+}
+
+func TestValidateZoneGroups(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Groups map[string][]manager.ZoneGroup
+		Expect string
+	}{
+		{
+			"no groups",
+			nil,
+			"",
+		},
+		{
+			"the same zone ID on different units",
+			map[string][]manager.ZoneGroup{
+				"ac1": {{Name: "Living Area", Zones: []string{"z01", "z02"}}},
+				"ac2": {{Name: "Upstairs", Zones: []string{"z01", "z02"}}},
+			},
+			"",
+		},
+		{
+			"a zone in several groups of the same unit",
+			map[string][]manager.ZoneGroup{
+				"ac1": {
+					{Name: "Living Area", Zones: []string{"z01", "z02"}},
+					{Name: "Kitchen", Zones: []string{"z03", "z01"}},
+				},
+			},
+			"the ac1/z01 zone is in both the 'Living Area' and 'Kitchen' groups",
+		},
+		{
+			"the first invalid unit in order of ID",
+			map[string][]manager.ZoneGroup{
+				"ac2": {{Name: "Upstairs", Zones: []string{"z01"}}},
+				"ac1": {{Name: "Downstairs", Zones: []string{"z01"}}},
+			},
+			"the 'Downstairs' zone group must have at least two zones",
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			err := validateZoneGroups(c.Groups)
+
+			if c.Expect == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != c.Expect {
+				t.Fatalf("unexpected error: got %v, want %q", err, c.Expect)
+			}
+		})
+	}
+}
+
+// parse parses the JSON representation of a MyPlace system.
+func parse(t *testing.T, data string) *myplace.System {
+	t.Helper()
+
+	sys, err := myplace.ParseSystem([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sys
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// setupPINKey is the key used to persist the randomly generated HomeKit
+	// PIN in the store.
+	setupPINKey = "airkit-setup-pin"
+
+	// setupIDKey is the key used to persist the HomeKit setup ID in the store.
+	setupIDKey = "airkit-setup-id"
+)
+
+// setupIDAlphabet is the set of characters used in HomeKit setup IDs.
+const setupIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// legacyPIN is the PIN that was used by every AirKit installation before
+// random PINs were generated.
+const legacyPIN = "12340000"
+
+// loadSetupCode returns the HomeKit PIN and setup ID, generating and
+// persisting new ones if necessary.
+//
+// If AIRKIT_HOMEKIT_PIN is set, it is used instead of the persisted PIN.
+func loadSetupCode(st hap.Store) (pin, setupID string, err error) {
+	pin, err = loadPIN(st)
+	if err != nil {
+		return "", "", err
+	}
+
+	setupID, err = loadSetupID(st)
+	if err != nil {
+		return "", "", err
+	}
+
+	return pin, setupID, nil
+}
+
+// loadPIN returns the HomeKit PIN, generating and persisting a new one if
+// necessary.
+func loadPIN(st hap.Store) (string, error) {
+	if pin, ok := homekitPIN.Value(); ok {
+		return pin, validatePIN(pin)
+	}
+
+	if v, err := st.Get(setupPINKey); err == nil && validatePIN(string(v)) == nil {
+		return string(v), nil
+	}
+
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+
+		pin := fmt.Sprintf("%08d", n.Int64())
+
+		if validatePIN(pin) == nil && !isTrivialPIN(pin) {
+			return pin, st.Set(setupPINKey, []byte(pin))
+		}
+	}
+}
+
+// loadSetupID returns the HomeKit setup ID, generating and persisting a new
+// one if necessary.
+//
+// The setup ID is advertised (as a hash) by the accessory server, and allows
+// the Home app to find the bridge when pairing via a QR code.
+func loadSetupID(st hap.Store) (string, error) {
+	if v, err := st.Get(setupIDKey); err == nil && len(v) == 4 {
+		return string(v), nil
+	}
+
+	var id strings.Builder
+	for i := 0; i < 4; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(setupIDAlphabet))))
+		if err != nil {
+			return "", err
+		}
+
+		id.WriteByte(setupIDAlphabet[n.Int64()])
+	}
+
+	if err := st.Set(setupIDKey, []byte(id.String())); err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
+
+// setupURI returns the "X-HM://" URI that is encoded in the QR code used to
+// pair a HomeKit bridge.
+func setupURI(pin, setupID string) (string, error) {
+	code, err := strconv.ParseUint(pin, 10, 27)
+	if err != nil || len(pin) != 8 {
+		return "", fmt.Errorf("invalid HomeKit PIN: %q", pin)
+	}
+
+	const (
+		version    = 0
+		flagIP     = 2
+		categoryAt = 31
+		flagsAt    = 27
+		versionAt  = 43
+	)
+
+	payload := uint64(version)<<versionAt |
+		uint64(accessory.TypeBridge)<<categoryAt |
+		uint64(flagIP)<<flagsAt |
+		code
+
+	enc := strings.ToUpper(strconv.FormatUint(payload, 36))
+	enc = strings.Repeat("0", 9-len(enc)) + enc
+
+	return "X-HM://" + enc + setupID, nil
+}
+
+// printSetupCode prints the HomeKit PIN, setup URI and a QR code that can be
+// scanned by the Home app to pair with the bridge.
+func printSetupCode(cmd *cobra.Command, pin, setupID string) error {
+	uri, err := setupURI(pin, setupID)
+	if err != nil {
+		return err
+	}
+
+	qr, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		return err
+	}
+
+	cmd.Printf("HomeKit PIN:       %s-%s-%s\n", pin[:3], pin[3:5], pin[5:])
+	cmd.Printf("HomeKit setup URI: %s\n", uri)
+	cmd.Println("")
+	cmd.Print(qr.ToSmallString(false))
+
+	return nil
+}
+
+// validatePIN returns an error if pin can not be used as a HomeKit PIN.
+func validatePIN(pin string) error {
+	if len(pin) != 8 {
+		return fmt.Errorf("the PIN must be exactly 8 digits, %q has %d characters", pin, len(pin))
+	}
+
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("the PIN must contain only digits, %q contains %q", pin, r)
+		}
+	}
+
+	if hap.InvalidPins[pin] {
+		return fmt.Errorf("the PIN %s is not permitted by the HomeKit specification", pin)
+	}
+
+	return nil
+}
+
+// isTrivialPIN returns true if pin is easily guessable.
+//
+// This includes the legacy default PIN and any PIN where each digit is the same as,
+// or one more or one less than, the previous digit.
+func isTrivialPIN(pin string) bool {
+	if pin == legacyPIN {
+		return true
+	}
+
+	for _, step := range []int{0, 1, -1} {
+		trivial := true
+
+		for i := 1; i < len(pin); i++ {
+			if int(pin[i])-int(pin[i-1]) != step {
+				trivial = false
+				break
+			}
+		}
+
+		if trivial {
+			return true
+		}
+	}
+
+	return false
+}
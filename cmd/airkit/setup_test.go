@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/brutella/hap"
+)
+
+func TestValidatePIN(t *testing.T) {
+	cases := []struct {
+		Name  string
+		PIN   string
+		Valid bool
+	}{
+		{"valid", "03145154", true},
+		{"too short", "0314515", false},
+		{"too long", "031451540", false},
+		{"formatted", "031-45-154", false},
+		{"non-digit", "0314515a", false},
+		{"forbidden by HomeKit", "12345678", false},
+		{"repeated digit", "11111111", false},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			err := validatePIN(c.PIN)
+
+			if c.Valid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !c.Valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestIsTrivialPIN(t *testing.T) {
+	cases := []struct {
+		PIN     string
+		Trivial bool
+	}{
+		{"03145154", false},
+		{legacyPIN, true},
+		{"55555555", true},
+		{"23456789", true},
+		{"98765432", true},
+		{"12345679", false},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.PIN, func(t *testing.T) {
+			if actual := isTrivialPIN(c.PIN); actual != c.Trivial {
+				t.Fatalf("unexpected result: got %t, want %t", actual, c.Trivial)
+			}
+		})
+	}
+}
+
+func TestLoadPIN(t *testing.T) {
+	t.Run("it generates and persists a valid PIN", func(t *testing.T) {
+		st := hap.NewMemStore()
+
+		pin, err := loadPIN(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := validatePIN(pin); err != nil {
+			t.Fatal(err)
+		}
+
+		if isTrivialPIN(pin) {
+			t.Fatalf("generated a trivial PIN: %s", pin)
+		}
+
+		if v, err := st.Get(setupPINKey); err != nil || string(v) != pin {
+			t.Fatalf("unexpected persisted PIN: got %q (%v), want %q", v, err, pin)
+		}
+	})
+
+	t.Run("it reuses the persisted PIN", func(t *testing.T) {
+		st := hap.NewMemStore()
+		if err := st.Set(setupPINKey, []byte("03145154")); err != nil {
+			t.Fatal(err)
+		}
+
+		pin, err := loadPIN(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pin != "03145154" {
+			t.Fatalf("unexpected PIN: got %s, want 03145154", pin)
+		}
+	})
+
+	t.Run("it replaces an invalid persisted PIN", func(t *testing.T) {
+		st := hap.NewMemStore()
+		if err := st.Set(setupPINKey, []byte("12345678")); err != nil {
+			t.Fatal(err)
+		}
+
+		pin, err := loadPIN(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := validatePIN(pin); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLoadSetupID(t *testing.T) {
+	st := hap.NewMemStore()
+
+	id, err := loadSetupID(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(id) != 4 {
+		t.Fatalf("unexpected setup ID length: got %d, want 4", len(id))
+	}
+
+	for _, r := range id {
+		if !strings.ContainsRune(setupIDAlphabet, r) {
+			t.Fatalf("unexpected character in setup ID %q: %q", id, r)
+		}
+	}
+
+	again, err := loadSetupID(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again != id {
+		t.Fatalf("setup ID was not persisted: got %s, want %s", again, id)
+	}
+}
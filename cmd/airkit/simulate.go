@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/jmalloc/airkit/myplace"
+	"github.com/jmalloc/airkit/simulator"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Run a simulated MyPlace API server from a system data dump.",
+		RunE: func(
+			cmd *cobra.Command,
+			args []string,
+		) error {
+			from, err := cmd.Flags().GetString("from")
+			if err != nil {
+				return err
+			}
+
+			listen, err := cmd.Flags().GetString("listen")
+			if err != nil {
+				return err
+			}
+
+			data, err := os.ReadFile(from)
+			if err != nil {
+				return err
+			}
+
+			if _, err := myplace.ParseSystem(data); err != nil {
+				return err
+			}
+
+			sim, err := simulator.New(data)
+			if err != nil {
+				return err
+			}
+
+			cmd.SilenceUsage = true
+
+			ctx := cmd.Context()
+			srv := &http.Server{
+				Addr:    listen,
+				Handler: sim,
+				BaseContext: func(net.Listener) context.Context {
+					return ctx
+				},
+			}
+
+			go func() {
+				<-ctx.Done()
+				srv.Close()
+			}()
+
+			log.Printf("serving simulated MyPlace API on %s", listen)
+
+			err = srv.ListenAndServe()
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+
+			return err
+		},
+	}
+
+	cmd.Flags().String("from", "", "The path to a system data dump produced by 'airkit dump'")
+	cmd.Flags().String("listen", ":"+myplace.DefaultPort, "The address on which to listen for API requests")
+	cmd.MarkFlagRequired("from")
+
+	root.AddCommand(cmd)
+}
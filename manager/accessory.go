@@ -1,22 +1,123 @@
 package manager
 
-import "github.com/jmalloc/airkit/myplace"
+import (
+	"encoding/json"
+	"fmt"
+	"log"
 
-const (
-	acFanSpeedOverrideID = 1
+	"github.com/jmalloc/airkit/myplace"
 )
 
-const (
-	zoneThermostatID      = 1
-	zoneMyZoneIndicatorID = 2
+// accessoryRole identifies the purpose of an accessory within an
+// air-conditioning unit or zone.
+type accessoryRole struct {
+	// Name is the name of the role within the accessory ID registry.
+	Name string
+
+	// LegacyID is the value that was combined with the unit and zone numbers
+	// to produce the accessory's ID before the registry existed.
+	LegacyID uint32
+}
+
+var (
+	acFanSpeedOverride      = accessoryRole{"fan-speed-override", 1}
+	acPassthroughThermostat = accessoryRole{"passthrough-thermostat", 2}
+	acOverrideSwitch        = accessoryRole{"override-switch", 3}
+	acAutomationSwitch      = accessoryRole{"automation-switch", 4}
 )
 
-func makeAirConAccessoryID(ac *myplace.AirCon, id uint32) uint64 {
-	idMask := uint64(ac.Number) << 56
-	return idMask | uint64(id)
+var (
+	zoneThermostat        = accessoryRole{"thermostat", 1}
+	zoneMyZoneIndicator   = accessoryRole{"myzone-indicator", 2}
+	zonePassthroughSwitch = accessoryRole{"passthrough-switch", 3}
+)
+
+// airConAccessoryID returns the HAP accessory ID of the unit-level accessory
+// with the given role.
+func (s *Settings) airConAccessoryID(ac *myplace.AirCon, r accessoryRole) uint64 {
+	return s.accessoryID(
+		fmt.Sprintf("%s/%s", airConKey(ac), r.Name),
+		uint64(ac.Number)<<56|uint64(r.LegacyID),
+	)
 }
 
-func makeZoneAccessoryID(ac *myplace.AirCon, z *myplace.Zone, id uint32) uint64 {
-	idMask := uint64(ac.Number)<<56 | uint64(z.Number)<<48
-	return idMask | uint64(id)
+// zoneAccessoryID returns the HAP accessory ID of the zone-level accessory
+// with the given role.
+func (s *Settings) zoneAccessoryID(ac *myplace.AirCon, z *myplace.Zone, r accessoryRole) uint64 {
+	return s.accessoryID(
+		fmt.Sprintf("%s/%s/%s", airConKey(ac), z.ID, r.Name),
+		uint64(ac.Number)<<56|uint64(z.Number)<<48|uint64(r.LegacyID),
+	)
+}
+
+// airConKey returns the part of the accessory ID registry key that identifies
+// an air-conditioning unit.
+//
+// It uses the unit's UID, which does not change if the unit is renumbered,
+// falling back to the unit's ID if the system does not report a UID.
+func airConKey(ac *myplace.AirCon) string {
+	if ac.Details.UID != "" {
+		return ac.Details.UID
+	}
+
+	return ac.ID
+}
+
+// accessoryIDsKey is the key under which the accessory ID registry is stored.
+const accessoryIDsKey = "airkit-accessory-ids"
+
+// loadAccessoryIDs loads the accessory ID registry from the store.
+func (s *Settings) loadAccessoryIDs() error {
+	s.accessoryIDs = map[string]uint64{}
+
+	if _, err := getValue(s.store, accessoryIDsKey, func(data []byte) error {
+		return json.Unmarshal(data, &s.accessoryIDs)
+	}); err != nil {
+		return fmt.Errorf("the accessory ID registry is invalid: %w", err)
+	}
+
+	return nil
+}
+
+// accessoryID returns the HAP accessory ID registered under the given key,
+// allocating a new ID if the key is not yet registered.
+//
+// Accessories that predate the registry were assigned IDs derived from the
+// unit and zone numbers. The legacy ID is allocated if it is not already in
+// use, so that existing HomeKit pairings, rooms and automations are unaffected
+// by the introduction of the registry.
+func (s *Settings) accessoryID(key string, legacy uint64) uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if id, ok := s.accessoryIDs[key]; ok {
+		return id
+	}
+
+	id := legacy
+	max := uint64(1) // ID 1 is reserved for the bridge
+	for _, x := range s.accessoryIDs {
+		if x == legacy {
+			id = 0
+		}
+		if x > max {
+			max = x
+		}
+	}
+
+	if id == 0 {
+		id = max + 1
+	}
+
+	s.accessoryIDs[key] = id
+
+	data, err := json.Marshal(s.accessoryIDs)
+	if err == nil {
+		err = setValue(s.store, accessoryIDsKey, data)
+	}
+	if err != nil {
+		log.Printf("unable to save the ID of the '%s' accessory: %s", key, err)
+	}
+
+	return id
 }
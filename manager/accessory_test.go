@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/brutella/hap"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestSettings_accessoryID(t *testing.T) {
+	store := hap.NewMemStore()
+
+	settings, err := NewSettings(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac := &myplace.AirCon{ID: "ac1", Number: 1}
+	ac.Details.UID = "0f038"
+	z1 := &myplace.Zone{ID: "z01", Number: 1}
+	z2 := &myplace.Zone{ID: "z02", Number: 2}
+
+	thermostat := settings.zoneAccessoryID(ac, z1, zoneThermostat)
+	automation := settings.airConAccessoryID(ac, acAutomationSwitch)
+
+	t.Run("it allocates the legacy IDs to existing accessories", func(t *testing.T) {
+		if want := uint64(1<<56 | 1<<48 | 1); thermostat != want {
+			t.Fatalf("unexpected ID: got %#x, want %#x", thermostat, want)
+		}
+
+		if want := uint64(1<<56 | 4); automation != want {
+			t.Fatalf("unexpected ID: got %#x, want %#x", automation, want)
+		}
+	})
+
+	t.Run("it keeps the IDs when the zones are renumbered", func(t *testing.T) {
+		settings, err := NewSettings(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// z02 is renumbered such that its legacy ID matches that of z01.
+		renumbered := &myplace.Zone{ID: "z02", Number: 1}
+		id := settings.zoneAccessoryID(ac, renumbered, zoneThermostat)
+
+		if id == thermostat {
+			t.Fatalf("expected a new ID, got %#x", id)
+		}
+
+		if x := settings.zoneAccessoryID(ac, z1, zoneThermostat); x != thermostat {
+			t.Fatalf("unexpected ID: got %#x, want %#x", x, thermostat)
+		}
+
+		if x := settings.zoneAccessoryID(ac, z2, zoneThermostat); x != id {
+			t.Fatalf("unexpected ID: got %#x, want %#x", x, id)
+		}
+	})
+
+	t.Run("it keeps the IDs when the unit is renumbered", func(t *testing.T) {
+		renumbered := &myplace.AirCon{ID: "ac2", Number: 2}
+		renumbered.Details.UID = ac.Details.UID
+
+		if x := settings.airConAccessoryID(renumbered, acAutomationSwitch); x != automation {
+			t.Fatalf("unexpected ID: got %#x, want %#x", x, automation)
+		}
+	})
+}
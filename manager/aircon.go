@@ -2,11 +2,9 @@ package manager
 
 import (
 	"fmt"
-	"strconv"
-	"sync"
+	"log"
 	"time"
 
-	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/service"
@@ -19,74 +17,282 @@ const constantZoneSyncInterval = 30 * time.Second
 
 // AirConManager manages the state of thermostat accessories for each zone of an
 // air-conditioning unit.
+//
+// The manager's state is only accessed by its event loop, which must be started
+// by calling Run().
 type AirConManager struct {
-	commands chan<- []myplace.Command
+	*eventLoop
+
+	settings *Settings
+	config   AirConConfig
 
-	m               sync.Mutex
 	ac              *myplace.AirCon
 	zoneAccessories []*zoneAccessories
 	commandsSentAt  time.Time
+	powerChangedAt  time.Time
+	activeMode      myplace.AirConMode
+	activeModeAt    time.Time
+	overrides       *overrides
+	automation      *accessory.Switch
+	automationFault *characteristic.StatusFault
+	isAutomated     bool
+	isMissing       bool
+	missingZones    map[string]bool
+	isStale         bool
+
+	// committed is the HomeKit settings of each thermostat as of the last
+	// time the unit reflected them, keyed by the thermostat's zone ID. The
+	// settings are reverted to these values if they can not be applied.
+	committed map[string]ZoneSettings
+}
+
+// AirConConfig is the configuration for an AirConManager.
+type AirConConfig struct {
+	// Strategy is the algorithm used to decide how the unit is operated. If it
+	// is nil, FavourCooling is used.
+	Strategy ControlStrategy
+
+	// Thresholds controls when zones call for heating or cooling. If it is
+	// nil, DefaultThresholds is used.
+	Thresholds *Thresholds
+
+	// Zones is the configuration for specific zones. The key is the zone ID,
+	// such as "z01".
+	Zones map[string]ZoneConfig
+
+	// ZoneGroups is a set of groups of zones that are each presented to
+	// HomeKit as a single thermostat. A zone may be a member of at most one
+	// group.
+	ZoneGroups []ZoneGroup
+
+	// Protection limits how often the unit is switched on and off, or between
+	// heating and cooling, regardless of the strategy's decisions.
+	Protection CompressorProtection
+
+	// DamperModulation enables proportional control of the dampers of open
+	// zones. If it is nil, open zones are opened fully.
+	DamperModulation *DamperModulation
+
+	// OverrideDuration is the amount of time for which automation of the unit
+	// (or a zone) is paused after it is changed by something other than
+	// AirKit, such as the wall panel. A zero value disables override
+	// detection.
+	OverrideDuration time.Duration
+
+	// Now returns the current time. If it is nil, time.Now() is used.
+	Now func() time.Time
+
+	// QuietPeriod is the amount of time that a characteristic must go without
+	// being changed in HomeKit before the change is handled, such that
+	// dragging a slider in the Home app results in a single change. If it is
+	// zero, changes are handled immediately.
+	QuietPeriod time.Duration
+
+	// Refresh, if non-nil, requests that the state of the unit is read as soon
+	// as possible. It is called when the zones' HomeKit settings change, so
+	// that the decisions made as a result are based on up-to-date state.
+	Refresh func()
+}
+
+// CompressorProtection is a set of limits that prevent the air-conditioning
+// unit's compressor from short-cycling.
+//
+// A zero-value duration disables the corresponding limit.
+type CompressorProtection struct {
+	// MinOnTime is the minimum amount of time that the unit must remain on
+	// before AirKit will turn it off.
+	MinOnTime time.Duration
+
+	// MinOffTime is the minimum amount of time that the unit must remain off
+	// before AirKit will turn it on.
+	MinOffTime time.Duration
+
+	// MinModeChangeInterval is the minimum amount of time that must elapse
+	// after the unit started or stopped heating (or cooling) before AirKit
+	// will switch it to cooling (or heating).
+	MinModeChangeInterval time.Duration
 }
 
 type zoneAccessories struct {
-	Accessories     []*accessory.A
-	Thermostat      *service.Thermostat
-	Battery         *characteristic.StatusLowBattery
-	MyZoneIndicator *service.ContactSensor
+	Accessories []*accessory.A
+
+	// ZoneID is the ID of the zone that the accessories represent.
+	ZoneID string
+
+	// Name is the name of the zone's thermostat, used in log messages.
+	Name string
+
+	// Hidden is true if the zone is excluded from HomeKit, in which case its
+	// accessories are not published and it is never opened or closed.
+	Hidden bool
+
+	// ThermostatZoneID is the ID of the zone under which the thermostat's
+	// settings are stored. It differs from the zone's own ID if the zone is a
+	// member of a group, in which case the thermostat is shared by all of the
+	// group's members.
+	ThermostatZoneID string
+
+	// Settings is a copy of the HomeKit settings of the zone's thermostat. It
+	// is shared by all of the members of a group.
+	//
+	// The event loop uses this copy rather than reading the thermostat's
+	// characteristics, which HomeKit may write to at any time.
+	Settings *ZoneSettings
+
+	Thermostat       *service.Thermostat
+	CoolingThreshold *characteristic.CoolingThresholdTemperature
+	HeatingThreshold *characteristic.HeatingThresholdTemperature
+	Battery          *characteristic.StatusLowBattery
+	Fault            *characteristic.StatusFault
+	MyZoneIndicator  *service.ContactSensor
+	MyZoneFault      *characteristic.StatusFault
+
+	// NeedsCooling and NeedsHeating are the results of the most recent
+	// evaluation of the zone's demand against its thresholds.
+	NeedsCooling bool
+	NeedsHeating bool
 }
 
 // NewAirConManager returns a manager for the given air-conditioning unit.
 func NewAirConManager(
-	store hap.Store,
+	settings *Settings,
 	commands chan<- []myplace.Command,
 	ac *myplace.AirCon,
+	config AirConConfig,
 ) *AirConManager {
 	m := &AirConManager{
-		commands: commands,
+		settings: settings,
+		config:   config,
 		ac:       ac,
 	}
+	m.eventLoop = newEventLoop(commands, ac.ID, config.QuietPeriod, m)
+
+	// We don't know when the unit was last switched on or off, or between
+	// heating and cooling. Assuming that it has just happened would block any
+	// change for the full protection period each time the configuration is
+	// reloaded or the accessories are rebuilt, so the protection limits only
+	// apply to the changes observed from now on.
+	m.activeMode = runningMode(ac)
+
+	m.overrides = newOverrides(settings, ac)
+	m.overrides.active.On.OnValueRemoteUpdate(onLoop(m.eventLoop, m.setOverrideActive))
+
+	m.automation = accessory.NewSwitch(
+		accessory.Info{
+			Name:         ac.Details.Name + " AirKit Automation",
+			Manufacturer: "Advantage Air & James Harris",
+			Model:        "MyAir Air Conditioner Automation",
+			SerialNumber: ac.ID,
+			Firmware: fmt.Sprintf(
+				"%d.%d",
+				ac.Details.FirmwareMajorVersion,
+				ac.Details.FirmwareMinorVersion,
+			),
+		},
+	)
+	m.automation.Id = settings.airConAccessoryID(ac, acAutomationSwitch)
+
+	m.automationFault = characteristic.NewStatusFault()
+	m.automation.Switch.AddC(m.automationFault.C)
+
+	v, _ := settings.AirCon(ac.ID)
+	m.isAutomated = !v.AutomationDisabled
+	m.automation.Switch.On.SetValue(m.isAutomated)
+	m.automation.Switch.On.OnValueUpdate(onValueUpdate(m.eventLoop, func(v, isRemote bool) {
+		if isRemote {
+			m.setAutomationEnabled(v)
+		} else {
+			m.isAutomated = v
+		}
+	}))
+
+	thermostats := map[string]*zoneAccessories{}
 
 	for _, z := range ac.Zones {
-		a := newZoneAccessories(ac, z)
-
-		a.Thermostat.TargetTemperature.OnValueRemoteUpdate(
-			func(v float64) {
-				m.m.Lock()
-				defer m.m.Unlock()
-				m.apply(false)
-			},
-		)
-
-		key := fmt.Sprintf("myplace-%s-%s-target-state", ac.ID, z.ID)
-		if v, err := store.Get(key); err == nil {
-			if i, err := strconv.Atoi(string(v)); err == nil {
-				a.Thermostat.TargetHeatingCoolingState.SetValue(i)
+		// Each zone has its own thermostat, unless it is a member of a group,
+		// in which case it shares a thermostat with the group's other members.
+		leader := m.groupMembers(ac, z.ID)[0]
+		t, ok := thermostats[leader.ID]
+		if !ok {
+			name := m.config.Zones[z.ID].displayName(z)
+			if g, ok := m.zoneGroup(z.ID); ok {
+				name = g.Name
 			}
+
+			t = m.newZoneThermostat(ac, leader, name)
+			thermostats[leader.ID] = t
+
+			t.Thermostat.TargetHeatingCoolingState.OnValueUpdate(onValueUpdate(m.eventLoop, func(v int, isRemote bool) {
+				t.Settings.TargetState = v
+				if isRemote {
+					m.onZoneChange(t)
+				}
+			}))
+			t.Thermostat.TargetTemperature.OnValueUpdate(onValueUpdate(m.eventLoop, func(v float64, isRemote bool) {
+				t.Settings.TargetTemp = v
+				if isRemote {
+					m.onZoneChange(t)
+				}
+			}))
+			t.CoolingThreshold.OnValueUpdate(onValueUpdate(m.eventLoop, func(v float64, isRemote bool) {
+				t.Settings.CoolingThreshold = v
+				if isRemote {
+					m.clampBand(t, coolingEnd)
+					m.onZoneChange(t)
+				}
+			}))
+			t.HeatingThreshold.OnValueUpdate(onValueUpdate(m.eventLoop, func(v float64, isRemote bool) {
+				t.Settings.HeatingThreshold = v
+				if isRemote {
+					m.clampBand(t, heatingEnd)
+					m.onZoneChange(t)
+				}
+			}))
 		}
 
-		a.Thermostat.TargetHeatingCoolingState.OnValueRemoteUpdate(
-			func(v int) {
-				store.Set(key, []byte(strconv.Itoa(v)))
+		a := &zoneAccessories{
+			ZoneID:           z.ID,
+			Name:             t.Name,
+			Hidden:           m.config.Zones[z.ID].Hidden,
+			ThermostatZoneID: t.ThermostatZoneID,
+			Settings:         t.Settings,
+			Thermostat:       t.Thermostat,
+			CoolingThreshold: t.CoolingThreshold,
+			HeatingThreshold: t.HeatingThreshold,
+			Battery:          t.Battery,
+			Fault:            t.Fault,
+		}
 
-				m.m.Lock()
-				defer m.m.Unlock()
-				m.apply(false)
-			},
-		)
+		if !ok {
+			a.Accessories = append(a.Accessories, t.Accessories...)
+		}
+
+		indicator, cs := newMyZoneIndicator(settings, ac, z, m.config.Zones[z.ID].displayName(z))
+		a.Accessories = append(a.Accessories, indicator)
+		a.MyZoneIndicator = cs
+		a.MyZoneFault = characteristic.NewStatusFault()
+		cs.AddC(a.MyZoneFault.C)
 
 		m.zoneAccessories = append(m.zoneAccessories, a)
 	}
 
 	m.update(ac)
+	m.updateFaults()
+	m.commitZones()
 
 	return m
 }
 
-func newZoneAccessories(ac *myplace.AirCon, z *myplace.Zone) *zoneAccessories {
-	n := fmt.Sprintf("%s %s", z.Name, ac.Details.Name)
+// newZoneThermostat returns the thermostat for the given zone, with its
+// HomeKit settings loaded from the store.
+func (m *AirConManager) newZoneThermostat(
+	ac *myplace.AirCon,
+	z *myplace.Zone,
+	name string,
+) *zoneAccessories {
 	t := accessory.NewThermostat(
 		accessory.Info{
-			Name:         n,
+			Name:         fmt.Sprintf("%s %s", name, ac.Details.Name),
 			Manufacturer: "Advantage Air & James Harris",
 			Model:        "MyAir Zone",
 			SerialNumber: fmt.Sprintf("%s.%s", ac.ID, z.ID),
@@ -97,22 +303,94 @@ func newZoneAccessories(ac *myplace.AirCon, z *myplace.Zone) *zoneAccessories {
 			),
 		},
 	)
-	t.Id = makeZoneAccessoryID(ac, z, zoneThermostatID)
+	t.Id = m.settings.zoneAccessoryID(ac, z, zoneThermostat)
 
-	t.Thermostat.TargetTemperature.SetMinValue(16)
-	t.Thermostat.TargetTemperature.SetMaxValue(32)
+	zc := m.config.Zones[z.ID]
+	min, max := zc.tempLimits()
+
+	t.Thermostat.TargetTemperature.SetMinValue(min)
+	t.Thermostat.TargetTemperature.SetMaxValue(max)
 	t.Thermostat.TargetTemperature.SetStepValue(1)
 
 	t.Thermostat.CurrentTemperature.SetMinValue(0)
 	t.Thermostat.CurrentTemperature.SetMaxValue(100)
 	t.Thermostat.CurrentTemperature.SetStepValue(0.1)
 
+	ct := characteristic.NewCoolingThresholdTemperature()
+	ct.SetMinValue(min)
+	ct.SetMaxValue(max)
+	ct.SetStepValue(1)
+	t.Thermostat.AddC(ct.C)
+
+	ht := characteristic.NewHeatingThresholdTemperature()
+	ht.SetMinValue(min)
+	ht.SetMaxValue(max)
+	ht.SetStepValue(1)
+	t.Thermostat.AddC(ht.C)
+
 	b := characteristic.NewStatusLowBattery()
 	t.Thermostat.AddC(b.C)
 
-	m := accessory.New(
+	f := characteristic.NewStatusFault()
+	t.Thermostat.AddC(f.C)
+
+	// The threshold temperatures are only used when the zone is in AUTO mode.
+	// They default to a band of 1°C either side of the zone's target
+	// temperature.
+	t.Thermostat.TargetTemperature.SetValue(zc.clampTemp(z.TargetTemp))
+	ct.SetValue(zc.clampTemp(z.TargetTemp + 1))
+	ht.SetValue(zc.clampTemp(z.TargetTemp - 1))
+
+	if v, ok := m.settings.Zone(ac.ID, z.ID); ok {
+		t.Thermostat.TargetHeatingCoolingState.SetValue(v.TargetState)
+
+		if v.TargetTemp != 0 {
+			t.Thermostat.TargetTemperature.SetValue(zc.clampTemp(v.TargetTemp))
+		}
+
+		if v.CoolingThreshold != 0 {
+			ct.SetValue(zc.clampTemp(v.CoolingThreshold))
+		}
+
+		if v.HeatingThreshold != 0 {
+			ht.SetValue(zc.clampTemp(v.HeatingThreshold))
+		}
+	}
+
+	heat, cool := zc.clampBand(ht.Value(), ct.Value(), heatingEnd)
+	ht.SetValue(heat)
+	ct.SetValue(cool)
+
+	return &zoneAccessories{
+		Accessories:      []*accessory.A{t.A},
+		ZoneID:           z.ID,
+		Name:             name,
+		ThermostatZoneID: z.ID,
+		Settings: &ZoneSettings{
+			TargetState:      t.Thermostat.TargetHeatingCoolingState.Value(),
+			TargetTemp:       t.Thermostat.TargetTemperature.Value(),
+			CoolingThreshold: ct.Value(),
+			HeatingThreshold: ht.Value(),
+		},
+		Thermostat:       t.Thermostat,
+		CoolingThreshold: ct,
+		HeatingThreshold: ht,
+		Battery:          b,
+		Fault:            f,
+	}
+}
+
+// newMyZoneIndicator returns a contact sensor that indicates whether the given
+// zone is the unit's MyZone.
+func newMyZoneIndicator(
+	settings *Settings,
+	ac *myplace.AirCon,
+	z *myplace.Zone,
+	name string,
+) (*accessory.A, *service.ContactSensor) {
+	a := accessory.New(
 		accessory.Info{
-			Name:         fmt.Sprintf("%s MyZone", z.Name),
+			Name:         fmt.Sprintf("%s MyZone", name),
 			Manufacturer: "Advantage Air & James Harris",
 			Model:        "MyAir Zone",
 			SerialNumber: fmt.Sprintf("%s.%s", ac.ID, z.ID),
@@ -124,51 +402,225 @@ func newZoneAccessories(ac *myplace.AirCon, z *myplace.Zone) *zoneAccessories {
 		},
 		accessory.TypeSensor,
 	)
-	m.Id = makeZoneAccessoryID(ac, z, zoneMyZoneIndicatorID)
+	a.Id = settings.zoneAccessoryID(ac, z, zoneMyZoneIndicator)
 
 	cs := service.NewContactSensor()
-	m.AddS(cs.S)
+	a.AddS(cs.S)
 
-	return &zoneAccessories{
-		Accessories:     []*accessory.A{t.A, m},
-		Thermostat:      t.Thermostat,
-		Battery:         b,
-		MyZoneIndicator: cs,
-	}
+	return a, cs
 }
 
 // Accessories returns the managed accessories.
 func (m *AirConManager) Accessories() []*accessory.A {
-	var accessories []*accessory.A
+	accessories := []*accessory.A{m.automation.A}
 
 	for _, a := range m.zoneAccessories {
-		accessories = append(accessories, a.Accessories...)
+		if !a.Hidden {
+			accessories = append(accessories, a.Accessories...)
+		}
+	}
+
+	if m.config.OverrideDuration != 0 {
+		accessories = append(accessories, m.overrides.accessory)
 	}
 
 	return accessories
 }
 
-// Update updates the accessory to represent the given state.
-func (m *AirConManager) Update(s *myplace.System) {
-	m.m.Lock()
-	defer m.m.Unlock()
+// onUpdate updates the accessories to represent the given state.
+//
+// If the unit is missing from s, its accessories are marked as faulty and the
+// unit is left alone until it reappears.
+func (m *AirConManager) onUpdate(s *myplace.System) {
+	ac, ok := s.AirConByID[m.ac.ID]
+	if !ok {
+		if !m.isMissing {
+			log.Printf("the '%s' air-conditioner is missing from the MyPlace system", m.ac.Details.Name)
+			m.isMissing = true
+		}
+
+		m.updateFaults()
+
+		return
+	}
 
-	ac := s.AirConByID[m.ac.ID]
+	if m.isMissing {
+		log.Printf("the '%s' air-conditioner has reappeared in the MyPlace system", m.ac.Details.Name)
+		m.isMissing = false
+	}
+
+	m.observe(ac)
+	m.detectOverrides(ac)
 	m.update(ac)
 	m.ac = ac
+	m.checkMissingZones()
+	m.updateFaults()
 
 	m.apply(true)
 }
 
+// onStale handles a change to whether the unit's state is stale.
+func (m *AirConManager) onStale(isStale bool) {
+	m.isStale = isStale
+	m.updateFaults()
+}
+
+// onWriteFailed handles a failure to apply the commands sent to the unit by
+// reverting the zones' HomeKit settings to those that the unit last reflected,
+// so that HomeKit does not show settings that were never applied.
+func (m *AirConManager) onWriteFailed() {
+	// The unit never applied the requested values, so seeing them later is
+	// no longer evidence that AirKit made the change.
+	m.overrides.forget()
+
+	for _, a := range m.zoneAccessories {
+		if a.ZoneID != a.ThermostatZoneID {
+			continue
+		}
+
+		v, ok := m.committed[a.ThermostatZoneID]
+		if !ok || v == *a.Settings {
+			continue
+		}
+
+		log.Printf("reverting the settings of the '%s' zone, as they could not be applied", a.Name)
+
+		a.Thermostat.TargetHeatingCoolingState.SetValue(v.TargetState)
+		a.Thermostat.TargetTemperature.SetValue(v.TargetTemp)
+		a.CoolingThreshold.SetValue(v.CoolingThreshold)
+		a.HeatingThreshold.SetValue(v.HeatingThreshold)
+		m.saveZone(a)
+	}
+}
+
+// commitZones records the current HomeKit settings of each thermostat as the
+// settings that the unit reflects.
+func (m *AirConManager) commitZones() {
+	m.committed = map[string]ZoneSettings{}
+
+	for _, a := range m.zoneAccessories {
+		m.committed[a.ThermostatZoneID] = *a.Settings
+	}
+}
+
+// updateFaults marks each of the unit's accessories as faulty if the unit's
+// state is stale or the unit is missing. Each zone's thermostat and MyZone
+// indicator is also marked as faulty if its zones are missing.
+func (m *AirConManager) updateFaults() {
+	isFault := m.isStale || m.isMissing
+
+	m.automationFault.SetValue(faultStatus(isFault))
+	m.overrides.fault.SetValue(faultStatus(isFault))
+
+	for _, a := range m.zoneAccessories {
+		a.MyZoneFault.SetValue(faultStatus(isFault || m.missingZones[a.ZoneID]))
+
+		if a.ZoneID == a.ThermostatZoneID {
+			isThermostatFault := isFault || len(m.groupMembers(m.ac, a.ZoneID)) == 0
+			a.Fault.SetValue(faultStatus(isThermostatFault))
+		}
+	}
+}
+
+// observe records changes to the unit's power and mode that are relevant to
+// compressor protection.
+func (m *AirConManager) observe(ac *myplace.AirCon) {
+	now := m.now()
+
+	if ac.Details.Power != m.ac.Details.Power {
+		m.powerChangedAt = now
+	}
+
+	// The mode change interval is measured from when the unit starts or stops
+	// heating or cooling, not from each time it is seen doing so, otherwise
+	// a unit that runs continuously could never change mode.
+	prev, mode := runningMode(m.ac), runningMode(ac)
+	if mode != prev {
+		if mode != "" {
+			m.activeMode = mode
+		}
+		m.activeModeAt = now
+	}
+}
+
+// runningMode returns the mode of the unit if it is heating or cooling, or an
+// empty string if it is not.
+func runningMode(ac *myplace.AirCon) myplace.AirConMode {
+	if ac.Details.Power == myplace.AirConPowerOn {
+		switch ac.Details.Mode {
+		case myplace.AirConModeCool, myplace.AirConModeHeat:
+			return ac.Details.Mode
+		}
+	}
+
+	return ""
+}
+
 // update updates the HomeKit accessories to match the air-conditioning unit.
+//
+// Zones that are missing from ac are skipped, as are zones that were not
+// present when the manager was created.
 func (m *AirConManager) update(ac *myplace.AirCon) {
-	for i, z := range ac.Zones {
-		a := m.zoneAccessories[i]
+	for _, a := range m.zoneAccessories {
+		if z, ok := ac.ZoneByID[a.ZoneID]; ok {
+			if z.Number == ac.Details.MyZoneNumber {
+				a.MyZoneIndicator.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+			} else {
+				a.MyZoneIndicator.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+			}
+		}
 
-		a.Thermostat.CurrentTemperature.SetValue(z.CurrentTemp)
-		a.Thermostat.TargetTemperature.SetValue(z.TargetTemp)
+		// The thermostat of a group is updated only once, using the state of
+		// all of its members.
+		if a.ZoneID != a.ThermostatZoneID {
+			continue
+		}
+
+		members := m.groupMembers(ac, a.ZoneID)
+		if len(members) == 0 {
+			continue
+		}
+
+		z := members[0]
+
+		if len(members) == 1 {
+			a.Thermostat.CurrentTemperature.SetValue(m.zoneTemp(z))
+		} else {
+			var temps []float64
+			for _, mz := range members {
+				if mz.Error == myplace.ZoneErrorNone {
+					temps = append(temps, m.zoneTemp(mz))
+				}
+			}
+
+			if len(temps) != 0 {
+				g, _ := m.zoneGroup(a.ZoneID)
+				a.Thermostat.CurrentTemperature.SetValue(g.Aggregate.apply(temps))
+			}
+		}
+
+		// Only copy the panel's target temperature to HomeKit when it is
+		// changed at the panel, so that a target set in HomeKit that the
+		// panel has not yet applied is not lost. In AUTO mode the panel's
+		// target temperature is one end of the zone's comfort band, not the
+		// HomeKit target temperature, so it is never copied.
+		if prev, ok := m.ac.ZoneByID[z.ID]; !ok || prev.TargetTemp != z.TargetTemp {
+			if cool, heat := allowedZoneModes(a.Settings.TargetState); !cool || !heat {
+				a.Thermostat.TargetTemperature.SetValue(
+					m.config.Zones[a.ThermostatZoneID].clampTemp(z.TargetTemp),
+				)
+				m.saveZone(a)
+			}
+		}
+
+		isOpen := false
+		isFault := false
+		for _, mz := range members {
+			isOpen = isOpen || mz.State == myplace.ZoneStateOpen
+			isFault = isFault || mz.Error != myplace.ZoneErrorNone
+		}
 
-		if z.State == myplace.ZoneStateClosed {
+		if !isOpen {
 			a.Thermostat.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateOff)
 		} else if ac.Details.Power == myplace.AirConPowerOff ||
 			ac.Details.Mode == myplace.AirConModeVent ||
@@ -181,16 +633,10 @@ func (m *AirConManager) update(ac *myplace.AirCon) {
 			a.Thermostat.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateHeat)
 		}
 
-		if z.Error == myplace.ZoneErrorNone {
-			a.Battery.SetValue(characteristic.StatusLowBatteryBatteryLevelNormal)
-		} else {
+		if isFault {
 			a.Battery.SetValue(characteristic.StatusLowBatteryBatteryLevelLow)
-		}
-
-		if z.Number == ac.Details.MyZoneNumber {
-			a.MyZoneIndicator.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
 		} else {
-			a.MyZoneIndicator.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+			a.Battery.SetValue(characteristic.StatusLowBatteryBatteryLevelNormal)
 		}
 	}
 }
@@ -201,11 +647,17 @@ func (m *AirConManager) apply(isPoll bool) {
 	constantZoneClosures := 0
 
 	defer func() {
+		// The unit reflects the HomeKit settings if there is nothing to send
+		// other than commands that it is permitted to ignore.
+		if isBestEffort(commands) {
+			m.commitZones()
+		}
+
 		if len(commands) == 0 {
 			return
 		}
 
-		now := time.Now()
+		now := m.now()
 
 		// If this apply() call is a result of a poll of the AC's current state
 		// (as opposed to a settings change made by a human), then we want to
@@ -218,21 +670,64 @@ func (m *AirConManager) apply(isPoll bool) {
 		}
 
 		m.commandsSentAt = now
-		m.commands <- commands
+		m.send(commands)
 	}()
 
-	for i, z := range m.ac.Zones {
-		t := m.zoneAccessories[i].Thermostat
-		target := t.TargetTemperature.Value()
-		if z.TargetTemp != target {
-			commands = append(commands, myplace.SetZoneTargetTemp(m.ac.ID, z, target))
+	now := m.now()
+	m.overrides.active.On.SetValue(m.overrides.isAnyActive(now))
+
+	d := m.evaluateDemand()
+
+	// Leave the unit alone entirely while automation is disabled, or while
+	// it's being controlled manually.
+	if !m.isAutomated || m.overrides.isUnitActive(now) {
+		return
+	}
+
+	// Zones that are missing from the panel's response are left out of the
+	// demand and left alone, but the unit is still operated for the remaining
+	// zones. If every zone is missing there is nothing to base a decision on.
+	if len(m.missingZones) == len(m.zoneAccessories) {
+		return
+	}
+
+	// Otherwise, leave any manually controlled zones alone and operate the
+	// unit to satisfy the remaining zones.
+	zones := d.Zones
+	d.Zones = nil
+	for _, z := range zones {
+		if !m.overrides.isZoneActive(now, z.Zone) {
+			d.Zones = append(d.Zones, z)
 		}
 	}
 
-	power, mode := m.targetMode()
+	power, mode := m.protect(
+		m.strategy().TargetMode(d),
+	)
+
+	for _, z := range d.Zones {
+		target := z.TargetTemp
+
+		// When a zone is in AUTO mode, set the MyPlace target temperature to
+		// whichever end of the zone's comfort band applies to the unit's
+		// mode, so that MyZone regulates towards it.
+		if power == myplace.AirConPowerOn {
+			if mode == myplace.AirConModeCool {
+				target = z.CoolTarget
+			} else if mode == myplace.AirConModeHeat {
+				target = z.HeatTarget
+			}
+		}
+
+		if z.Zone.TargetTemp != target {
+			commands = append(commands, myplace.SetZoneTargetTemp(m.ac.ID, z.Zone, target))
+			m.overrides.expect("zone-"+z.Zone.ID+"-target", target)
+		}
+	}
 
 	if power != m.ac.Details.Power {
 		commands = append(commands, myplace.SetAirConPower(m.ac.ID, power))
+		m.overrides.expect("power", power)
 	}
 
 	if power == myplace.AirConPowerOff {
@@ -241,132 +736,266 @@ func (m *AirConManager) apply(isPoll bool) {
 
 	if mode != m.ac.Details.Mode {
 		commands = append(commands, myplace.SetAirConMode(m.ac.ID, mode))
+		m.overrides.expect("mode", mode)
 	}
 
 	isCooling := mode == myplace.AirConModeCool
-	open, closed := m.partitionZones(isCooling)
+	open, closed := m.strategy().PartitionZones(d, isCooling)
 
 	for _, z := range open {
-		if z.State != myplace.ZoneStateOpen {
-			commands = append(commands, myplace.SetZoneState(m.ac.ID, z, myplace.ZoneStateOpen))
+		if z.Zone.State != myplace.ZoneStateOpen {
+			commands = append(commands, myplace.SetZoneState(m.ac.ID, z.Zone, myplace.ZoneStateOpen))
+			m.overrides.expect("zone-"+z.Zone.ID+"-state", myplace.ZoneStateOpen)
+		}
+	}
+
+	my, hasMyZone := m.strategy().SelectMyZone(d, isCooling, open)
+	if hasMyZone {
+		if m.ac.Details.MyZoneNumber != my.Zone.Number {
+			commands = append(commands, myplace.SetMyZone(m.ac.ID, my.Zone))
+			m.overrides.expect("myzone", my.Zone.Number)
 		}
 	}
 
-	if z, ok := m.selectMyZone(isCooling, open); ok {
-		if m.ac.Details.MyZoneNumber != z.Number {
-			commands = append(commands, myplace.SetMyZone(m.ac.ID, z))
+	if dm := m.config.DamperModulation; dm != nil {
+		for _, z := range open {
+			// The MyZone is always opened fully, as the unit regulates its
+			// output based on the MyZone's temperature.
+			p := 100
+			if !hasMyZone || z.Zone != my.Zone {
+				p = dm.Percentage(z, isCooling)
+			}
+
+			if z.Zone.DamperPercentage != p {
+				commands = append(commands, myplace.SetZoneDamperPercentage(m.ac.ID, z.Zone, p))
+			}
 		}
 	}
 
 	for _, z := range closed {
-		if z.State != myplace.ZoneStateClosed {
-			commands = append(commands, myplace.SetZoneState(m.ac.ID, z, myplace.ZoneStateClosed))
+		if z.Zone.State != myplace.ZoneStateClosed {
+			c := myplace.SetZoneState(m.ac.ID, z.Zone, myplace.ZoneStateClosed)
 
-			if m.ac.IsConstantZone(z) {
+			// The unit may keep a constant zone open regardless, so the
+			// closure is not retried or reported as a failure.
+			if m.ac.IsConstantZone(z.Zone) {
+				c = c.BestEffort()
 				constantZoneClosures++
 			}
+
+			commands = append(commands, c)
+			m.overrides.expect("zone-"+z.Zone.ID+"-state", myplace.ZoneStateClosed)
 		}
 	}
 }
 
-// targetMode returns the desired power and mode for the air-conditioner.
-//
-// It always favours cooling over heating. That is, if any zone requires
-// cooling, the entire unit will be switched to cool and must reach temperature
-// before the unit will be switched to heat.
-func (m *AirConManager) targetMode() (myplace.AirConPower, myplace.AirConMode) {
-	var needsHeating bool
-
-	// Cool until we're a little below the target temperature. This is an
-	// attempt to let the AC regulate the temperature. That is, we only switch
-	// the unit off if the AC is over-cooling.
-	const coolThreshold = -0.1
-
-	// Don't start heating until we're below the target temperature. This is an
-	// attempt avoid continually switching between heating and cooling when
-	// zones are set to AUTO. In general, we favour cooling over heating.
-	const heatThreshold = -0.5
+// setAutomationEnabled handles a change to the "AirKit Automation" switch in
+// HomeKit.
+func (m *AirConManager) setAutomationEnabled(v bool) {
+	if err := m.settings.SetAirCon(
+		m.ac.ID,
+		AirConSettings{AutomationDisabled: !v},
+	); err != nil {
+		log.Printf("unable to save the settings for the '%s' air-conditioner: %s", m.ac.Details.Name, err)
+	}
+
+	m.isAutomated = v
+
+	// Any changes made while automation was disabled were made deliberately,
+	// so there is no need to hold off now that it has been re-enabled.
+	if v {
+		m.overrides.clear()
+	}
 
+	m.apply(false)
+	m.refresh()
+}
+
+// onZoneChange handles a change to the HomeKit settings of a zone's
+// thermostat.
+func (m *AirConManager) onZoneChange(a *zoneAccessories) {
+	m.saveZone(a)
+	m.apply(false)
+	m.refresh()
+}
+
+// clampBand moves one of the threshold temperatures of a zone's thermostat
+// such that the heating threshold is below the cooling threshold, leaving the
+// given end of the band as it is if possible.
+func (m *AirConManager) clampBand(a *zoneAccessories, keep bandEnd) {
+	heat, cool := m.config.Zones[a.ThermostatZoneID].clampBand(
+		a.Settings.HeatingThreshold,
+		a.Settings.CoolingThreshold,
+		keep,
+	)
+
+	a.HeatingThreshold.SetValue(heat)
+	a.CoolingThreshold.SetValue(cool)
+}
+
+// saveZone persists the HomeKit settings of a zone's thermostat.
+func (m *AirConManager) saveZone(a *zoneAccessories) {
+	if err := m.settings.SetZone(
+		m.ac.ID,
+		a.ThermostatZoneID,
+		*a.Settings,
+	); err != nil {
+		log.Printf("unable to save the settings for the '%s' zone: %s", a.Name, err)
+	}
+}
+
+// checkMissingZones records which of the zones that were present when the
+// manager was created are missing from the unit's current state, and logs each
+// zone that goes missing or reappears.
+func (m *AirConManager) checkMissingZones() {
 	for _, a := range m.zoneAccessories {
-		cool, heat := allowedZoneModes(a.Thermostat)
-		current := a.Thermostat.CurrentTemperature.Value()
-		target := a.Thermostat.TargetTemperature.Value()
-		delta := current - target
+		_, ok := m.ac.ZoneByID[a.ZoneID]
+
+		if !ok && !m.missingZones[a.ZoneID] {
+			log.Printf("the '%s' zone is missing from the MyPlace system, it is ignored until it reappears", a.Name)
+
+			if m.missingZones == nil {
+				m.missingZones = map[string]bool{}
+			}
+			m.missingZones[a.ZoneID] = true
+		} else if ok && m.missingZones[a.ZoneID] {
+			log.Printf("the '%s' zone has reappeared in the MyPlace system", a.Name)
+			delete(m.missingZones, a.ZoneID)
+		}
+	}
+}
 
-		if cool && delta > coolThreshold {
-			return myplace.AirConPowerOn, myplace.AirConModeCool
+// protect returns the power and mode that the unit should use, given the
+// power and mode chosen by the strategy, after enforcing the compressor
+// protection limits.
+func (m *AirConManager) protect(
+	power myplace.AirConPower,
+	mode myplace.AirConMode,
+) (myplace.AirConPower, myplace.AirConMode) {
+	p := m.config.Protection
+	now := m.now()
+	current := m.ac.Details
+
+	if power != current.Power {
+		sinceChange := now.Sub(m.powerChangedAt)
+
+		if current.Power == myplace.AirConPowerOn && sinceChange < p.MinOnTime {
+			return current.Power, current.Mode
 		}
 
-		if heat && delta < heatThreshold {
-			needsHeating = true
+		if current.Power == myplace.AirConPowerOff && sinceChange < p.MinOffTime {
+			return current.Power, current.Mode
 		}
 	}
 
-	if needsHeating {
-		return myplace.AirConPowerOn, myplace.AirConModeHeat
+	if power == myplace.AirConPowerOn &&
+		m.activeMode != "" &&
+		mode != m.activeMode &&
+		now.Sub(m.activeModeAt) < p.MinModeChangeInterval {
+		if current.Power == myplace.AirConPowerOn {
+			return current.Power, current.Mode
+		}
+
+		return myplace.AirConPowerOff, current.Mode
 	}
 
-	return myplace.AirConPowerOff, m.ac.Details.Mode
+	return power, mode
 }
 
-// partioningZones returns two sets of zones, containing the zones that must be
-// opened, and closed, respectively.
-func (m *AirConManager) partitionZones(isCooling bool) (open, closed []*myplace.Zone) {
-	for i, z := range m.ac.Zones {
-		cool, heat := allowedZoneModes(m.zoneAccessories[i].Thermostat)
+// evaluateDemand returns the state of the air-conditioning unit and the
+// HomeKit settings of each of its zones.
+//
+// It records whether each zone is calling for heating or cooling so that the
+// next evaluation can apply the correct thresholds.
+func (m *AirConManager) evaluateDemand() Demand {
+	d := Demand{
+		AirCon: m.ac,
+	}
+
+	for _, a := range m.zoneAccessories {
+		z, ok := m.ac.ZoneByID[a.ZoneID]
+		if !ok || a.Hidden {
+			continue
+		}
+
+		cool, heat := allowedZoneModes(a.Settings.TargetState)
 
-		if (isCooling && cool) || (!isCooling && heat) {
-			open = append(open, z)
+		zd := ZoneDemand{
+			Zone:         z,
+			CurrentTemp:  a.Thermostat.CurrentTemperature.Value(),
+			TargetTemp:   a.Settings.TargetTemp,
+			AllowCooling: cool,
+			AllowHeating: heat,
+			Thresholds:   m.thresholds(a.ThermostatZoneID),
+		}
+
+		if cool && heat {
+			zd.CoolTarget = a.Settings.CoolingThreshold
+			zd.HeatTarget = a.Settings.HeatingThreshold
 		} else {
-			closed = append(closed, z)
+			zd.CoolTarget = zd.TargetTemp
+			zd.HeatTarget = zd.TargetTemp
 		}
+
+		zd.NeedsCooling = cool && zd.Thresholds.Cooling(zd.CoolDelta(), a.NeedsCooling)
+		zd.NeedsHeating = heat && zd.Thresholds.Heating(zd.HeatDelta(), a.NeedsHeating)
+
+		a.NeedsCooling = zd.NeedsCooling
+		a.NeedsHeating = zd.NeedsHeating
+
+		d.Zones = append(d.Zones, zd)
 	}
 
-	return open, closed
+	return d
 }
 
-// selectMyZone returns the best zone to use as the MyZone.
-func (m *AirConManager) selectMyZone(isCooling bool, zones []*myplace.Zone) (*myplace.Zone, bool) {
-	var my *myplace.Zone
-	var max float64
+// thresholds returns the thresholds to use for the given zone.
+func (m *AirConManager) thresholds(zoneID string) Thresholds {
+	if t := m.config.Zones[zoneID].Thresholds; t != nil {
+		return *t
+	}
 
-	for _, z := range zones {
-		// Don't consider the zone a candidate for MyZone if we don't even want
-		// it on.
-		if z.State != myplace.ZoneStateOpen {
-			continue
-		}
+	if m.config.Thresholds != nil {
+		return *m.config.Thresholds
+	}
 
-		// Don't consider the zone a candidate for MyZone if we can't measure
-		// the temperature.
-		if z.Error == myplace.ZoneErrorNoSignal {
-			continue
-		}
+	return DefaultThresholds
+}
 
-		t := m.zoneAccessories[z.Number-1].Thermostat
+// zoneTemp returns the calibrated temperature of the given zone.
+func (m *AirConManager) zoneTemp(z *myplace.Zone) float64 {
+	return z.CurrentTemp + m.config.Zones[z.ID].CalibrationOffset
+}
 
-		current := t.CurrentTemperature.Value()
-		target := t.TargetTemperature.Value()
-		delta := current - target
+// strategy returns the control strategy used to operate the unit.
+func (m *AirConManager) strategy() ControlStrategy {
+	if m.config.Strategy != nil {
+		return m.config.Strategy
+	}
 
-		// if we're not cooling, favour the lowest delta (ie, current < target)
-		if !isCooling {
-			delta = -delta
-		}
+	return FavourCooling{}
+}
 
-		if my == nil || delta > max {
-			my = z
-			max = delta
-		}
+// refresh requests that the state of the unit is read as soon as possible.
+func (m *AirConManager) refresh() {
+	if m.config.Refresh != nil {
+		m.config.Refresh()
 	}
+}
 
-	return my, my != nil
+// now returns the current time.
+func (m *AirConManager) now() time.Time {
+	if m.config.Now != nil {
+		return m.config.Now()
+	}
+
+	return time.Now()
 }
 
-// allowedZoneModes returns booleans indicating whether a thermostat allows a
-// zone to be heated and/or cooled.
-func allowedZoneModes(t *service.Thermostat) (cool, heat bool) {
-	switch t.TargetHeatingCoolingState.Value() {
+// allowedZoneModes returns booleans indicating whether a thermostat's target
+// heating/cooling state allows a zone to be heated and/or cooled.
+func allowedZoneModes(targetState int) (cool, heat bool) {
+	switch targetState {
 	case characteristic.TargetHeatingCoolingStateCool:
 		return true, false
 	case characteristic.TargetHeatingCoolingStateHeat:
@@ -377,3 +1006,14 @@ func allowedZoneModes(t *service.Thermostat) (cool, heat bool) {
 		return false, false
 	}
 }
+
+// isBestEffort returns true if none of the given commands need to be applied.
+func isBestEffort(commands []myplace.Command) bool {
+	for _, c := range commands {
+		if !c.IsBestEffort() {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,654 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/characteristic"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestAirConManager_hysteresis(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+	now := time.Now()
+
+	sys := newTestSystem(24.1)
+	sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+	m := NewAirConManager(
+		newTestSettings(t),
+		commands,
+		sys.AirCons[0],
+		AirConConfig{
+			Thresholds: &Thresholds{
+				CoolStart: 0.2,
+				CoolStop:  0.2,
+				HeatStart: 0.5,
+				HeatStop:  0.5,
+			},
+			Now: func() time.Time { return now },
+		},
+	)
+
+	m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+
+	t.Run("it does not start cooling within the deadband", func(t *testing.T) {
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+	})
+
+	t.Run("it starts cooling above the start threshold", func(t *testing.T) {
+		sys = newTestSystem(24.3)
+		sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+		sys.AirCons[0].Zones[0].State = myplace.ZoneStateClosed
+
+		m.onUpdate(sys)
+		expectCommands(
+			t,
+			commands,
+			"power ac1 on",
+			"set ac1#1 (Living) to on",
+		)
+	})
+
+	t.Run("it continues cooling below the target temperature", func(t *testing.T) {
+		sys = newTestSystem(23.9)
+
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+	})
+
+	t.Run("it stops cooling below the stop threshold", func(t *testing.T) {
+		sys = newTestSystem(23.7)
+
+		m.onUpdate(sys)
+		expectCommands(t, commands, "power ac1 off")
+	})
+
+	t.Run("it does not restart cooling within the deadband", func(t *testing.T) {
+		sys = newTestSystem(24.1)
+		sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+	})
+}
+
+func TestAirConManager_comfortBand(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+	now := time.Now()
+
+	sys := newTestSystem(24)
+	sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+	m := NewAirConManager(
+		newTestSettings(t),
+		commands,
+		sys.AirCons[0],
+		AirConConfig{
+			Thresholds: &Thresholds{
+				CoolStart: 0.2,
+				CoolStop:  0.2,
+				HeatStart: 0.2,
+				HeatStop:  0.2,
+			},
+			Now: func() time.Time { return now },
+		},
+	)
+
+	a := m.zoneAccessories[0]
+	a.Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateAuto,
+	)
+	a.CoolingThreshold.SetValue(26)
+	a.HeatingThreshold.SetValue(20)
+
+	t.Run("it does nothing within the comfort band", func(t *testing.T) {
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+	})
+
+	t.Run("it cools to the upper bound", func(t *testing.T) {
+		sys = newTestSystem(26.3)
+		sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+		m.onUpdate(sys)
+		expectCommands(
+			t,
+			commands,
+			"set ac1#1 (Living) target temperature to 26.0°C",
+			"power ac1 on",
+		)
+	})
+
+	t.Run("it heats to the lower bound", func(t *testing.T) {
+		now = now.Add(time.Hour)
+
+		sys = newTestSystem(19.7)
+		sys.AirCons[0].Zones[0].TargetTemp = 26
+
+		m.onUpdate(sys)
+		expectCommands(
+			t,
+			commands,
+			"set ac1#1 (Living) target temperature to 20.0°C",
+			"set ac1 mode to heat",
+		)
+	})
+}
+
+func TestAirConManager_invertedComfortBand(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newManager := func(settings *Settings) (*AirConManager, *zoneAccessories) {
+		m := NewAirConManager(
+			settings,
+			make(chan []myplace.Command, 100),
+			newTestSystem(24).AirCons[0],
+			AirConConfig{},
+		)
+
+		go m.Run(ctx)
+
+		return m, m.zoneAccessories[0]
+	}
+
+	expectBand := func(t *testing.T, a *zoneAccessories, heat, cool float64) {
+		t.Helper()
+
+		if h, c := a.HeatingThreshold.Value(), a.CoolingThreshold.Value(); h != heat || c != cool {
+			t.Fatalf("unexpected thresholds: got %.1f°C - %.1f°C, want %.1f°C - %.1f°C", h, c, heat, cool)
+		}
+
+		if h, c := a.Settings.HeatingThreshold, a.Settings.CoolingThreshold; h != heat || c != cool {
+			t.Fatalf("unexpected settings: got %.1f°C - %.1f°C, want %.1f°C - %.1f°C", h, c, heat, cool)
+		}
+	}
+
+	t.Run("it lowers the heating threshold below a new cooling threshold", func(t *testing.T) {
+		m, a := newManager(newTestSettings(t))
+
+		a.CoolingThreshold.SetValueRequest(20.0, &http.Request{})
+
+		if err := m.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		expectBand(t, a, 19, 20)
+	})
+
+	t.Run("it raises the cooling threshold above a new heating threshold", func(t *testing.T) {
+		m, a := newManager(newTestSettings(t))
+
+		a.HeatingThreshold.SetValueRequest(28.0, &http.Request{})
+
+		if err := m.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		expectBand(t, a, 28, 29)
+	})
+
+	t.Run("it keeps the band within the zone's temperature limits", func(t *testing.T) {
+		m, a := newManager(newTestSettings(t))
+
+		a.CoolingThreshold.SetValueRequest(float64(DefaultMinTemp), &http.Request{})
+
+		if err := m.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		expectBand(t, a, DefaultMinTemp, DefaultMinTemp+MinComfortBand)
+	})
+
+	t.Run("it corrects inverted thresholds when they are loaded", func(t *testing.T) {
+		settings := newTestSettings(t)
+		if err := settings.SetZone("ac1", "z01", ZoneSettings{
+			TargetState:      characteristic.TargetHeatingCoolingStateAuto,
+			TargetTemp:       24,
+			CoolingThreshold: 20,
+			HeatingThreshold: 22,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, a := newManager(settings)
+
+		expectBand(t, a, 22, 23)
+	})
+}
+
+func TestAirConManager_automationSwitch(t *testing.T) {
+	settings := newTestSettings(t)
+	commands := make(chan []myplace.Command, 100)
+
+	sys := newTestSystem(26)
+	sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+	m := NewAirConManager(settings, commands, sys.AirCons[0], AirConConfig{})
+	m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+	m.saveZone(m.zoneAccessories[0])
+
+	m.automation.Switch.On.SetValue(false)
+	m.setAutomationEnabled(false)
+	expectCommands(t, commands)
+
+	t.Run("it does not send commands while automation is disabled", func(t *testing.T) {
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+	})
+
+	t.Run("it remembers that automation is disabled", func(t *testing.T) {
+		m = NewAirConManager(settings, commands, sys.AirCons[0], AirConConfig{})
+
+		if m.automation.Switch.On.Value() {
+			t.Fatal("expected automation to be disabled")
+		}
+
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+	})
+
+	t.Run("it resumes when automation is enabled", func(t *testing.T) {
+		m.automation.Switch.On.SetValue(true)
+		m.setAutomationEnabled(true)
+		expectCommands(t, commands, "power ac1 on")
+	})
+}
+
+func TestAirConManager_topologyChanges(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+
+	sys := newTestSystem(26)
+	m := NewAirConManager(newTestSettings(t), commands, sys.AirCons[0], AirConConfig{})
+	a := m.zoneAccessories[0]
+	a.Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+
+	t.Run("it marks the zones as faulty when the unit is missing", func(t *testing.T) {
+		m.onUpdate(&myplace.System{})
+		expectCommands(t, commands)
+
+		if v := a.Fault.Value(); v != characteristic.StatusFaultGeneralFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultGeneralFault)
+		}
+	})
+
+	t.Run("it marks a zone as faulty when the zone is missing", func(t *testing.T) {
+		s := newTestSystem(26)
+		s.AirCons[0].ZoneByID = map[string]*myplace.Zone{}
+		s.AirCons[0].Zones = nil
+
+		m.onUpdate(s)
+		expectCommands(t, commands)
+
+		if v := a.Fault.Value(); v != characteristic.StatusFaultGeneralFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultGeneralFault)
+		}
+	})
+
+	t.Run("it operates the unit for the zones that are not missing", func(t *testing.T) {
+		sys := newTestSystem(26)
+		z := &myplace.Zone{
+			ID:             "z02",
+			Number:         2,
+			Name:           "Bedroom",
+			State:          myplace.ZoneStateOpen,
+			HasTempControl: 1,
+			CurrentTemp:    26,
+			TargetTemp:     24,
+		}
+		sys.AirCons[0].ZoneByID[z.ID] = z
+		sys.AirCons[0].Zones = append(sys.AirCons[0].Zones, z)
+		sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+		commands := make(chan []myplace.Command, 100)
+		m := NewAirConManager(newTestSettings(t), commands, sys.AirCons[0], AirConConfig{})
+		m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+			characteristic.TargetHeatingCoolingStateCool,
+		)
+
+		s := newTestSystem(26)
+		s.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+		m.onUpdate(s)
+		expectCommands(t, commands, "power ac1 on")
+	})
+
+	t.Run("it ignores zones that were added after it was created", func(t *testing.T) {
+		s := newTestSystem(26)
+		z := &myplace.Zone{
+			ID:     "z02",
+			Number: 2,
+			Name:   "Bedroom",
+			State:  myplace.ZoneStateOpen,
+		}
+		s.AirCons[0].ZoneByID[z.ID] = z
+		s.AirCons[0].Zones = append(s.AirCons[0].Zones, z)
+
+		m.onUpdate(s)
+		expectCommands(t, commands)
+
+		if v := a.Fault.Value(); v != characteristic.StatusFaultNoFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultNoFault)
+		}
+	})
+}
+
+func TestAirConManager_writeFailed(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+
+	settings := newTestSettings(t)
+	sys := newTestSystem(26)
+	m := NewAirConManager(settings, commands, sys.AirCons[0], AirConConfig{})
+
+	a := m.zoneAccessories[0]
+	a.Thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateCool)
+	m.onUpdate(sys)
+	expectCommands(t, commands)
+
+	a.Thermostat.TargetTemperature.SetValue(22)
+	m.onZoneChange(a)
+	expectCommands(t, commands, "set ac1#1 (Living) target temperature to 22.0°C")
+
+	t.Run("it reverts HomeKit changes that could not be applied", func(t *testing.T) {
+		m.onWriteFailed()
+
+		if v := a.Thermostat.TargetTemperature.Value(); v != 24 {
+			t.Fatalf("unexpected target temperature: got %v, want 24", v)
+		}
+
+		if v, _ := settings.Zone("ac1", "z01"); v.TargetTemp != 24 {
+			t.Fatalf("unexpected saved target temperature: got %v, want 24", v.TargetTemp)
+		}
+
+		if v := a.Thermostat.TargetHeatingCoolingState.Value(); v != characteristic.TargetHeatingCoolingStateCool {
+			t.Fatalf("unexpected target state: got %d, want %d", v, characteristic.TargetHeatingCoolingStateCool)
+		}
+	})
+
+	t.Run("it keeps HomeKit changes once the unit has applied them", func(t *testing.T) {
+		a.Thermostat.TargetTemperature.SetValue(23)
+		m.onZoneChange(a)
+		expectCommands(t, commands, "set ac1#1 (Living) target temperature to 23.0°C")
+
+		sys := newTestSystem(26)
+		sys.AirCons[0].Zones[0].TargetTemp = 23
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		m.onWriteFailed()
+
+		if v := a.Thermostat.TargetTemperature.Value(); v != 23 {
+			t.Fatalf("unexpected target temperature: got %v, want 23", v)
+		}
+	})
+}
+
+func TestAirConManager_stale(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+
+	sys := newTestSystem(24)
+	m := NewAirConManager(newTestSettings(t), commands, sys.AirCons[0], AirConConfig{})
+	a := m.zoneAccessories[0]
+
+	faults := map[string]*characteristic.StatusFault{
+		"thermostat":        a.Fault,
+		"MyZone indicator":  a.MyZoneFault,
+		"automation switch": m.automationFault,
+		"override switch":   m.overrides.fault,
+	}
+
+	expectFaults := func(t *testing.T, expect int) {
+		t.Helper()
+
+		for n, f := range faults {
+			if v := f.Value(); v != expect {
+				t.Fatalf("unexpected fault status of the %s: got %d, want %d", n, v, expect)
+			}
+		}
+	}
+
+	t.Run("it marks every accessory as faulty while the state is stale", func(t *testing.T) {
+		m.onStale(true)
+		expectFaults(t, characteristic.StatusFaultGeneralFault)
+
+		m.onUpdate(sys)
+		expectFaults(t, characteristic.StatusFaultGeneralFault)
+	})
+
+	t.Run("it clears the faults once the state is no longer stale", func(t *testing.T) {
+		m.onStale(false)
+		expectFaults(t, characteristic.StatusFaultNoFault)
+	})
+}
+
+func TestAirConManager_compressorProtection(t *testing.T) {
+	start := time.Now()
+
+	newManager := func(
+		sys *myplace.System,
+		p CompressorProtection,
+		now *time.Time,
+	) (*AirConManager, chan []myplace.Command) {
+		commands := make(chan []myplace.Command, 100)
+
+		*now = start
+		m := NewAirConManager(
+			newTestSettings(t),
+			commands,
+			sys.AirCons[0],
+			AirConConfig{
+				Protection: p,
+				Now:        func() time.Time { return *now },
+			},
+		)
+
+		return m, commands
+	}
+
+	t.Run("it does not assume the unit has just changed when it is created", func(t *testing.T) {
+		var now time.Time
+		sys := newTestSystem(20)
+		m, commands := newManager(
+			sys,
+			CompressorProtection{
+				MinOnTime:             10 * time.Minute,
+				MinOffTime:            10 * time.Minute,
+				MinModeChangeInterval: 30 * time.Minute,
+			},
+			&now,
+		)
+		m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+			characteristic.TargetHeatingCoolingStateCool,
+		)
+
+		m.onUpdate(sys)
+		expectCommands(t, commands, "power ac1 off")
+	})
+
+	t.Run("it keeps the unit on for the minimum on time", func(t *testing.T) {
+		var now time.Time
+		off := newTestSystem(20)
+		off.AirCons[0].Details.Power = myplace.AirConPowerOff
+		m, commands := newManager(off, CompressorProtection{MinOnTime: 10 * time.Minute}, &now)
+		m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+			characteristic.TargetHeatingCoolingStateCool,
+		)
+
+		// The unit is switched on at the panel.
+		sys := newTestSystem(20)
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		now = start.Add(9 * time.Minute)
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		now = start.Add(10 * time.Minute)
+		m.onUpdate(sys)
+		expectCommands(t, commands, "power ac1 off")
+	})
+
+	t.Run("it keeps the unit off for the minimum off time", func(t *testing.T) {
+		var now time.Time
+		on := newTestSystem(20)
+		m, commands := newManager(on, CompressorProtection{MinOffTime: 10 * time.Minute}, &now)
+		m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+			characteristic.TargetHeatingCoolingStateCool,
+		)
+
+		// The unit is switched off at the panel.
+		sys := newTestSystem(26)
+		sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		now = start.Add(9 * time.Minute)
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		now = start.Add(10 * time.Minute)
+		m.onUpdate(sys)
+		expectCommands(t, commands, "power ac1 on")
+	})
+
+	t.Run("it changes the mode of a running unit after the interval", func(t *testing.T) {
+		var now time.Time
+		off := newTestSystem(28)
+		off.AirCons[0].Details.Power = myplace.AirConPowerOff
+		m, commands := newManager(off, CompressorProtection{MinModeChangeInterval: 30 * time.Minute}, &now)
+
+		a := m.zoneAccessories[0]
+		a.Thermostat.TargetHeatingCoolingState.SetValue(
+			characteristic.TargetHeatingCoolingStateAuto,
+		)
+		a.CoolingThreshold.SetValue(22)
+		a.HeatingThreshold.SetValue(18)
+
+		// The unit starts heating at the panel.
+		sys := newTestSystem(28)
+		sys.AirCons[0].Details.Mode = myplace.AirConModeHeat
+		sys.AirCons[0].Zones[0].TargetTemp = 18
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		// The unit keeps heating while it is polled, which must not extend the
+		// interval.
+		for d := 5 * time.Minute; d < 30*time.Minute; d += 5 * time.Minute {
+			now = start.Add(d)
+			m.onUpdate(sys)
+			expectCommands(t, commands)
+		}
+
+		now = start.Add(30 * time.Minute)
+		m.onUpdate(sys)
+		expectCommands(
+			t,
+			commands,
+			"set ac1#1 (Living) target temperature to 22.0°C",
+			"set ac1 mode to cool",
+		)
+	})
+
+	t.Run("it measures the interval from when the unit stopped heating", func(t *testing.T) {
+		var now time.Time
+		sys := newTestSystem(28)
+		sys.AirCons[0].Details.Mode = myplace.AirConModeHeat
+		m, commands := newManager(sys, CompressorProtection{MinModeChangeInterval: 30 * time.Minute}, &now)
+		m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+			characteristic.TargetHeatingCoolingStateCool,
+		)
+
+		off := newTestSystem(28)
+		off.AirCons[0].Details.Mode = myplace.AirConModeHeat
+		off.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+		now = start.Add(time.Hour)
+		m.onUpdate(off)
+		expectCommands(t, commands)
+
+		now = start.Add(time.Hour + 29*time.Minute)
+		m.onUpdate(off)
+		expectCommands(t, commands)
+
+		now = start.Add(time.Hour + 30*time.Minute)
+		m.onUpdate(off)
+		expectCommands(t, commands, "power ac1 on", "set ac1 mode to cool")
+	})
+}
+
+// newTestSettings returns an empty settings store.
+func newTestSettings(t *testing.T) *Settings {
+	t.Helper()
+
+	s, err := NewSettings(hap.NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// newTestSystem returns a system with a single air-conditioning unit that is
+// cooling a single open zone with the given temperature and a target of 24°C.
+func newTestSystem(temp float64) *myplace.System {
+	z := &myplace.Zone{
+		ID:             "z01",
+		Number:         1,
+		Name:           "Living",
+		State:          myplace.ZoneStateOpen,
+		HasTempControl: 1,
+		CurrentTemp:    temp,
+		TargetTemp:     24,
+	}
+
+	ac := &myplace.AirCon{
+		ID:       "ac1",
+		Number:   1,
+		ZoneByID: map[string]*myplace.Zone{z.ID: z},
+		Zones:    []*myplace.Zone{z},
+	}
+	ac.Details.Name = "AC"
+	ac.Details.Power = myplace.AirConPowerOn
+	ac.Details.Mode = myplace.AirConModeCool
+	ac.Details.MyZoneNumber = 1
+
+	return &myplace.System{
+		AirCons:    []*myplace.AirCon{ac},
+		AirConByID: map[string]*myplace.AirCon{ac.ID: ac},
+	}
+}
+
+// expectCommands asserts that the next batch of commands sent by a manager
+// matches the given descriptions, or that no commands were sent if there are no
+// descriptions.
+func expectCommands(t *testing.T, commands <-chan []myplace.Command, expect ...string) {
+	t.Helper()
+
+	var actual []myplace.Command
+
+	select {
+	case actual = <-commands:
+	default:
+	}
+
+	if len(actual) != len(expect) {
+		t.Fatalf("unexpected commands: got %v, want %v", actual, expect)
+	}
+
+	for i, c := range actual {
+		if c.String() != expect[i] {
+			t.Fatalf("unexpected commands: got %v, want %v", actual, expect)
+		}
+	}
+}
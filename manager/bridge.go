@@ -7,6 +7,9 @@ import (
 	"github.com/jmalloc/airkit/myplace"
 )
 
+// BridgeName is the name of the HomeKit bridge accessory.
+const BridgeName = "MyPlace"
+
 // NewBridge returns a new thermostat attached to the given system.
 func NewBridge(
 	version string,
@@ -14,7 +17,7 @@ func NewBridge(
 ) *accessory.Bridge {
 	return accessory.NewBridge(
 		accessory.Info{
-			Name:         "MyPlace",
+			Name:         BridgeName,
 			Manufacturer: "Advantage Air & James Harris",
 			Model:        s.Details.TouchScreenModel,
 			SerialNumber: "Unknown",
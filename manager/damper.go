@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+)
+
+// DamperModulation configures proportional control of zone dampers.
+//
+// Rather than opening each zone's damper fully, the damper is opened in
+// proportion to how far the zone is from its target temperature. Zones that
+// are close to their target are throttled instead of being repeatedly opened
+// and closed.
+type DamperModulation struct {
+	// Band is the distance (in °C) from a zone's target temperature at which
+	// its damper is opened fully.
+	Band float64
+
+	// MinPercentage is the smallest amount (as a percentage) by which the
+	// damper of an open zone is opened.
+	MinPercentage int
+}
+
+// damperStep is the increment in which MyPlace accepts damper percentages.
+const damperStep = 5
+
+// Validate returns an error if the modulation settings are invalid.
+func (d DamperModulation) Validate() error {
+	if d.Band <= 0 {
+		return fmt.Errorf("the damper band (%.1f°C) must be positive", d.Band)
+	}
+
+	if d.MinPercentage < damperStep || d.MinPercentage > 100 {
+		return fmt.Errorf(
+			"the minimum damper percentage (%d%%) must be between %d%% and 100%%",
+			d.MinPercentage,
+			damperStep,
+		)
+	}
+
+	return nil
+}
+
+// Percentage returns the amount (as a percentage) by which the damper of an
+// open zone is opened.
+func (d DamperModulation) Percentage(z ZoneDemand, isCooling bool) int {
+	distance := z.CoolDelta()
+	if !isCooling {
+		distance = -z.HeatDelta()
+	}
+
+	f := math.Max(0, math.Min(1, distance/d.Band))
+	p := float64(d.MinPercentage) + f*float64(100-d.MinPercentage)
+
+	return int(math.Round(p/damperStep)) * damperStep
+}
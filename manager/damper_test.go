@@ -0,0 +1,44 @@
+package manager
+
+import "testing"
+
+func TestDamperModulation_Percentage(t *testing.T) {
+	dm := DamperModulation{
+		Band:          2,
+		MinPercentage: 20,
+	}
+
+	cases := []struct {
+		Name      string
+		Current   float64
+		IsCooling bool
+		Expect    int
+	}{
+		{"cooling, below target", 23, true, 20},
+		{"cooling, at target", 24, true, 20},
+		{"cooling, half way to band", 25, true, 60},
+		{"cooling, at band", 26, true, 100},
+		{"cooling, beyond band", 30, true, 100},
+		{"cooling, rounded to nearest step", 24.3, true, 30},
+		{"heating, above target", 25, false, 20},
+		{"heating, half way to band", 23, false, 60},
+		{"heating, beyond band", 18, false, 100},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			z := ZoneDemand{
+				CurrentTemp: c.Current,
+				TargetTemp:  24,
+				CoolTarget:  24,
+				HeatTarget:  24,
+			}
+
+			if p := dm.Percentage(z, c.IsCooling); p != c.Expect {
+				t.Fatalf("unexpected percentage: got %d, want %d", p, c.Expect)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package manager
 
 import (
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
@@ -22,24 +24,40 @@ import (
 // fan speed, allowing phrases like "Turn off the fan speed override".  I
 // couldn't work out any combination of characteristics that would allow phrases
 // like "Set the fan speed to auto", which would be ideal.
+//
+// The manager's state is only accessed by its event loop, which must be started
+// by calling Run().
 type FanManager struct {
-	commands  chan<- []myplace.Command
+	*eventLoop
+
+	settings  *Settings
 	acID      string
+	ac        *myplace.AirCon
+	isMissing bool
+	isStale   bool
 	autoSpeed myplace.FanSpeed
 	prevSpeed myplace.FanSpeed
 	accessory *accessory.A
 	fan       *service.FanV2
 	speed     *characteristic.RotationSpeed
+	fault     *characteristic.StatusFault
 }
 
 // NewFanManager returns a manager for the given air-conditioning unit's fan.
+//
+// Changes made in HomeKit are handled once the characteristic has not been
+// changed for the given quiet period. If it is zero, they are handled
+// immediately.
 func NewFanManager(
+	settings *Settings,
 	commands chan<- []myplace.Command,
 	ac *myplace.AirCon,
+	quietPeriod time.Duration,
 ) *FanManager {
 	m := &FanManager{
-		commands: commands,
+		settings: settings,
 		acID:     ac.ID,
+		ac:       ac,
 		accessory: accessory.New(
 			accessory.Info{
 				Name:         ac.Details.Name + " Fan Speed Override",
@@ -56,15 +74,23 @@ func NewFanManager(
 		),
 		fan:       service.NewFanV2(),
 		speed:     characteristic.NewRotationSpeed(),
+		fault:     characteristic.NewStatusFault(),
 		prevSpeed: myplace.FanSpeedMedium,
 	}
-	m.accessory.Id = makeAirConAccessoryID(ac, acFanSpeedOverrideID)
+	m.accessory.Id = settings.airConAccessoryID(ac, acFanSpeedOverride)
+	m.eventLoop = newEventLoop(commands, ac.ID, quietPeriod, m)
+
+	if v, ok := settings.Fan(ac.ID); ok {
+		m.prevSpeed = v.PrevSpeed
+	}
 
 	m.accessory.AddS(m.fan.S)
-	m.fan.Active.OnValueRemoteUpdate(m.setFanActive)
+	m.fan.Active.OnValueRemoteUpdate(onLoop(m.eventLoop, m.setFanActive))
 
 	m.fan.AddC(m.speed.C)
-	m.speed.OnValueRemoteUpdate(m.setFanSpeed)
+	m.speed.OnValueRemoteUpdate(onLoop(m.eventLoop, m.setFanSpeed))
+
+	m.fan.AddC(m.fault.C)
 
 	m.update(ac)
 
@@ -78,10 +104,37 @@ func (m *FanManager) Accessories() []*accessory.A {
 	}
 }
 
-// Update updates the accessory to represent the given state.
-func (m *FanManager) Update(s *myplace.System) {
-	ac := s.AirConByID[m.acID]
-	m.update(ac)
+// onUpdate updates the accessory to represent the given state.
+//
+// If the unit is missing from s, the accessory is marked as faulty.
+func (m *FanManager) onUpdate(s *myplace.System) {
+	ac, ok := s.AirConByID[m.acID]
+	m.isMissing = !ok
+
+	if ok {
+		m.ac = ac
+		m.update(ac)
+	}
+
+	m.updateFault()
+}
+
+// onStale handles a change to whether the unit's state is stale.
+func (m *FanManager) onStale(isStale bool) {
+	m.isStale = isStale
+	m.updateFault()
+}
+
+// onWriteFailed handles a failure to apply the commands sent to the unit by
+// reverting the accessory to the unit's most recently read state.
+func (m *FanManager) onWriteFailed() {
+	m.update(m.ac)
+}
+
+// updateFault marks the accessory as faulty if the unit's state is stale or
+// the unit is missing.
+func (m *FanManager) updateFault() {
+	m.fault.SetValue(faultStatus(m.isStale || m.isMissing))
 }
 
 func (m *FanManager) update(ac *myplace.AirCon) {
@@ -89,7 +142,7 @@ func (m *FanManager) update(ac *myplace.AirCon) {
 	case myplace.FanSpeedAutoHardware, myplace.FanSpeedAutoSoftware:
 		m.fan.Active.SetValue(characteristic.ActiveInactive)
 	default:
-		m.prevSpeed = ac.Details.FanSpeed
+		m.setPrevSpeed(ac.Details.FanSpeed)
 		m.fan.Active.SetValue(characteristic.ActiveActive)
 		m.speed.SetValue(m.marshalFanSpeed(ac.Details.FanSpeed))
 	}
@@ -101,17 +154,31 @@ func (m *FanManager) update(ac *myplace.AirCon) {
 	}
 }
 
+// setPrevSpeed sets the speed to use when the override is turned on, and
+// persists it if it has changed.
+func (m *FanManager) setPrevSpeed(v myplace.FanSpeed) {
+	if v == m.prevSpeed {
+		return
+	}
+
+	m.prevSpeed = v
+
+	if err := m.settings.SetFan(m.acID, FanSettings{PrevSpeed: v}); err != nil {
+		log.Printf("unable to save the fan settings: %s", err)
+	}
+}
+
 func (m *FanManager) setFanActive(v int) {
 	switch v {
 	case characteristic.ActiveActive:
-		m.commands <- []myplace.Command{myplace.SetFanSpeed(m.acID, m.prevSpeed)}
+		m.send([]myplace.Command{myplace.SetFanSpeed(m.acID, m.prevSpeed)})
 	case characteristic.ActiveInactive:
-		m.commands <- []myplace.Command{myplace.SetFanSpeed(m.acID, m.autoSpeed)}
+		m.send([]myplace.Command{myplace.SetFanSpeed(m.acID, m.autoSpeed)})
 	}
 }
 
 func (m *FanManager) setFanSpeed(v float64) {
-	m.commands <- []myplace.Command{myplace.SetFanSpeed(m.acID, m.unmarshalFanSpeed(v))}
+	m.send([]myplace.Command{myplace.SetFanSpeed(m.acID, m.unmarshalFanSpeed(v))})
 }
 
 func (m *FanManager) marshalFanSpeed(v myplace.FanSpeed) float64 {
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+// ZoneGroup is a set of zones that are presented to HomeKit as a single
+// thermostat, such as an open-plan living area that spans several zones.
+//
+// The zones in a group are always opened and closed together. The group's
+// HomeKit settings are stored under the ID of its first zone, which is also
+// used to look up the group's configuration in AirConConfig.Zones.
+type ZoneGroup struct {
+	// Name is the name of the group's thermostat in HomeKit.
+	Name string
+
+	// Zones is the IDs of the member zones, such as "z01".
+	Zones []string
+
+	// Aggregate is the function used to combine the temperatures of the
+	// member zones. If it is empty, AverageTemp is used.
+	Aggregate TempAggregate
+}
+
+// TempAggregate is a function that combines the temperatures of several zones
+// into a single temperature.
+type TempAggregate string
+
+const (
+	// AverageTemp uses the mean temperature of the member zones.
+	AverageTemp TempAggregate = "average"
+
+	// MinTemp uses the temperature of the coolest member zone.
+	MinTemp TempAggregate = "min"
+
+	// MaxTemp uses the temperature of the warmest member zone.
+	MaxTemp TempAggregate = "max"
+)
+
+// Validate returns an error if the group is invalid.
+func (g ZoneGroup) Validate() error {
+	if g.Name == "" {
+		return fmt.Errorf("the zone group must have a name")
+	}
+
+	if len(g.Zones) < 2 {
+		return fmt.Errorf("the '%s' zone group must have at least two zones", g.Name)
+	}
+
+	switch g.Aggregate {
+	case "", AverageTemp, MinTemp, MaxTemp:
+		return nil
+	default:
+		return fmt.Errorf(
+			"the '%s' zone group has an unknown aggregate (%s), expected %s, %s or %s",
+			g.Name,
+			g.Aggregate,
+			AverageTemp,
+			MinTemp,
+			MaxTemp,
+		)
+	}
+}
+
+// apply returns the aggregate of the given temperatures. temps must not be
+// empty.
+func (a TempAggregate) apply(temps []float64) float64 {
+	t := temps[0]
+
+	for _, v := range temps[1:] {
+		switch a {
+		case MinTemp:
+			t = math.Min(t, v)
+		case MaxTemp:
+			t = math.Max(t, v)
+		default:
+			t += v
+		}
+	}
+
+	if a != MinTemp && a != MaxTemp {
+		t /= float64(len(temps))
+	}
+
+	return t
+}
+
+// zoneGroup returns the group that contains the zone with the given ID, if
+// any.
+func (m *AirConManager) zoneGroup(zoneID string) (ZoneGroup, bool) {
+	for _, g := range m.config.ZoneGroups {
+		for _, id := range g.Zones {
+			if id == zoneID {
+				return g, true
+			}
+		}
+	}
+
+	return ZoneGroup{}, false
+}
+
+// groupMembers returns the zones of ac that are in the same group as the zone
+// with the given ID, including that zone itself. If the zone is not in a
+// group, it returns only that zone.
+//
+// Zones that are not present in ac are omitted, so the result may be empty.
+func (m *AirConManager) groupMembers(ac *myplace.AirCon, zoneID string) []*myplace.Zone {
+	g, ok := m.zoneGroup(zoneID)
+	if !ok {
+		if z, ok := ac.ZoneByID[zoneID]; ok {
+			return []*myplace.Zone{z}
+		}
+		return nil
+	}
+
+	var members []*myplace.Zone
+	for _, id := range g.Zones {
+		if mz, ok := ac.ZoneByID[id]; ok {
+			members = append(members, mz)
+		}
+	}
+
+	return members
+}
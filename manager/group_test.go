@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestAirConManager_zoneGroups(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+	now := time.Now()
+
+	newSystem := func(living, kitchen float64) *myplace.System {
+		sys := newTestSystem(living)
+		ac := sys.AirCons[0]
+		ac.Details.Power = myplace.AirConPowerOff
+
+		z := &myplace.Zone{
+			ID:             "z02",
+			Number:         2,
+			Name:           "Kitchen",
+			State:          myplace.ZoneStateClosed,
+			HasTempControl: 1,
+			CurrentTemp:    kitchen,
+			TargetTemp:     24,
+		}
+		ac.Zones = append(ac.Zones, z)
+		ac.ZoneByID[z.ID] = z
+		ac.Zones[0].State = myplace.ZoneStateClosed
+
+		return sys
+	}
+
+	sys := newSystem(24, 24)
+
+	m := NewAirConManager(
+		newTestSettings(t),
+		commands,
+		sys.AirCons[0],
+		AirConConfig{
+			ZoneGroups: []ZoneGroup{
+				{
+					Name:      "Living Area",
+					Zones:     []string{"z01", "z02"},
+					Aggregate: AverageTemp,
+				},
+			},
+			Now: func() time.Time { return now },
+		},
+	)
+
+	t.Run("it publishes a single thermostat for the group", func(t *testing.T) {
+		a0 := m.zoneAccessories[0]
+		a1 := m.zoneAccessories[1]
+
+		if a0.Thermostat != a1.Thermostat {
+			t.Fatal("expected the members to share a thermostat")
+		}
+
+		thermostats := 0
+		for _, a := range m.Accessories() {
+			if a.Type == accessory.TypeThermostat {
+				thermostats++
+			}
+		}
+
+		if thermostats != 1 {
+			t.Fatalf("unexpected number of thermostats: got %d, want 1", thermostats)
+		}
+	})
+
+	m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+
+	t.Run("it opens the members together based on the aggregate temperature", func(t *testing.T) {
+		sys = newSystem(26, 23)
+
+		m.onUpdate(sys)
+		expectCommands(
+			t,
+			commands,
+			"power ac1 on",
+			"set ac1#1 (Living) to on",
+			"set ac1#2 (Kitchen) to on",
+		)
+
+		if v := m.zoneAccessories[0].Thermostat.CurrentTemperature.Value(); v != 24.5 {
+			t.Fatalf("unexpected current temperature: got %v, want 24.5", v)
+		}
+	})
+}
@@ -0,0 +1,399 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+// eventLoopCapacity is the number of functions that may be queued by post()
+// before the caller is made to wait for the manager to catch up.
+const eventLoopCapacity = 16
+
+// DefaultQuietPeriod is the default amount of time that a characteristic must
+// go without being changed in HomeKit before the change is handled.
+const DefaultQuietPeriod = 500 * time.Millisecond
+
+// eventLoop serializes the handling of HomeKit changes and MyPlace state
+// updates for a single accessory manager, such that the manager's state is
+// only ever accessed by one goroutine.
+//
+// It is designed such that it can not deadlock with the code that reads the
+// MyPlace system:
+//
+//   - HomeKit changes never wait, which allows the HomeKit server to hold the
+//     HomeKit lock while it reports them. Each change is held back until its
+//     characteristic has been quiet for the quiet period, and replaces any
+//     earlier change to the same characteristic that has not been handled.
+//   - State updates and changes to the unit's health never wait, instead each
+//     one replaces any of the same kind that has not yet been handled.
+//   - Commands are sent from the event loop itself, which waits if the
+//     commands channel is full, but only until the loop is stopped. It
+//     releases the HomeKit lock while it waits.
+type eventLoop struct {
+	commands chan<- []myplace.Command
+	events   chan func()
+	updated  chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// done is closed when the loop is asked to stop. It is only accessed by
+	// the event loop, and is nil until Run() is called.
+	done <-chan struct{}
+
+	// homeKit is the lock that serializes access to the values of HomeKit
+	// characteristics. It is shared with the HomeKit server by
+	// SerializeRequests().
+	homeKit *sync.Mutex
+
+	// isLocked is true while the event loop holds the HomeKit lock. It is only
+	// accessed by the event loop.
+	isLocked bool
+
+	unitID      string
+	handler     eventHandler
+	quietPeriod time.Duration
+
+	// nextKey is the key of the next characteristic to be registered with
+	// onLoop() or onValueUpdate(). It is only accessed while the manager is
+	// being constructed.
+	nextKey int
+
+	m         sync.Mutex
+	pending   map[string]func()
+	order     []string
+	debounced map[int]*debounced
+}
+
+// debounced is a HomeKit change that is being held back until its
+// characteristic has been quiet for the quiet period.
+type debounced struct {
+	fn    func()
+	timer *time.Timer
+}
+
+// eventHandler handles the events of an event loop.
+type eventHandler interface {
+	// onUpdate handles a change to the state of the MyPlace system.
+	onUpdate(s *myplace.System)
+
+	// onStale handles a change to whether the unit's state is stale.
+	onStale(isStale bool)
+
+	// onWriteFailed handles a failure to apply the commands sent to the
+	// unit.
+	onWriteFailed()
+}
+
+// newEventLoop returns an event loop that sends commands on the given channel
+// and passes the events of the air-conditioning unit with the given ID to h.
+//
+// HomeKit changes are handled once their characteristic has not been changed
+// for the given quiet period. If it is zero, they are handled immediately.
+func newEventLoop(
+	commands chan<- []myplace.Command,
+	unitID string,
+	quietPeriod time.Duration,
+	h eventHandler,
+) *eventLoop {
+	return &eventLoop{
+		commands:    commands,
+		events:      make(chan func(), eventLoopCapacity),
+		updated:     make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+		homeKit:     &sync.Mutex{},
+		unitID:      unitID,
+		handler:     h,
+		quietPeriod: quietPeriod,
+		pending:     map[string]func(){},
+		debounced:   map[int]*debounced{},
+	}
+}
+
+// Run handles HomeKit changes and state updates until ctx is canceled.
+func (l *eventLoop) Run(ctx context.Context) error {
+	defer l.stopOnce.Do(func() { close(l.stopped) })
+
+	l.done = ctx.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case fn := <-l.events:
+			l.handle(fn)
+		case <-l.updated:
+			l.handle(l.handlePending)
+		}
+	}
+}
+
+// handle calls fn while holding the HomeKit lock, such that the manager may
+// update the values of its characteristics.
+func (l *eventLoop) handle(fn func()) {
+	l.homeKit.Lock()
+	l.isLocked = true
+
+	defer func() {
+		l.isLocked = false
+		l.homeKit.Unlock()
+	}()
+
+	fn()
+}
+
+// useLock makes the event loop hold the given lock while it handles events,
+// instead of its own lock.
+func (l *eventLoop) useLock(lock *sync.Mutex) {
+	l.homeKit = lock
+}
+
+// Update records s as the most recent state of the MyPlace system, to be
+// handled by the event loop.
+//
+// It never blocks. If a previous state has not yet been handled it is
+// discarded.
+func (l *eventLoop) Update(s *myplace.System) {
+	l.coalesce("update", func() {
+		l.handler.onUpdate(s)
+	})
+}
+
+// SetStale marks the accessories of the unit with the given ID as faulty while
+// its state is stale.
+//
+// It never blocks. It does nothing if the manager does not manage the unit.
+func (l *eventLoop) SetStale(unitID string, isStale bool) {
+	if unitID == l.unitID {
+		l.coalesce("stale", func() {
+			l.handler.onStale(isStale)
+		})
+	}
+}
+
+// WriteFailed reverts any HomeKit changes to the unit with the given ID that
+// could not be applied to the unit.
+//
+// It never blocks. It does nothing if the manager does not manage the unit.
+func (l *eventLoop) WriteFailed(unitID string) {
+	if unitID == l.unitID {
+		l.coalesce("write-failed", l.handler.onWriteFailed)
+	}
+}
+
+// Sync blocks until all HomeKit changes, state updates and changes to the
+// unit's health made before it was called have been handled.
+//
+// HomeKit changes that are being held back until their characteristic is
+// quiet are handled without waiting for the quiet period to elapse.
+func (l *eventLoop) Sync(ctx context.Context) error {
+	done := make(chan struct{})
+
+	l.flushAll()
+
+	l.post(func() {
+		l.handlePending()
+		close(done)
+	})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.stopped:
+		return context.Canceled
+	case <-done:
+		return nil
+	}
+}
+
+// post queues fn to be called by the event loop.
+//
+// It blocks if the queue is full, and does nothing once the loop has stopped.
+func (l *eventLoop) post(fn func()) {
+	select {
+	case l.events <- fn:
+	case <-l.stopped:
+	}
+}
+
+// send sends commands to the MyPlace system.
+//
+// It must only be called from the event loop. It blocks if the commands channel
+// is full, and discards the commands if the loop is asked to stop while it is
+// waiting.
+func (l *eventLoop) send(commands []myplace.Command) {
+	select {
+	case l.commands <- commands:
+		return
+	default:
+	}
+
+	// Don't hold up HomeKit requests while waiting for the commands to be
+	// read.
+	if l.isLocked {
+		l.homeKit.Unlock()
+		defer l.homeKit.Lock()
+	}
+
+	select {
+	case l.commands <- commands:
+	case <-l.done:
+	}
+}
+
+// coalesce queues fn to be called by the event loop, replacing any function
+// with the same key that has not yet been called.
+//
+// It never blocks, regardless of the state of the event loop.
+func (l *eventLoop) coalesce(key string, fn func()) {
+	l.m.Lock()
+	l.queue(key, fn)
+	l.m.Unlock()
+
+	l.notify()
+}
+
+// queue queues fn to be called by the event loop, replacing any function with
+// the same key that has not yet been called.
+//
+// l.m must be held.
+func (l *eventLoop) queue(key string, fn func()) {
+	if _, ok := l.pending[key]; !ok {
+		l.order = append(l.order, key)
+	}
+	l.pending[key] = fn
+}
+
+// notify wakes the event loop to call the functions queued by queue().
+func (l *eventLoop) notify() {
+	select {
+	case l.updated <- struct{}{}:
+	default:
+	}
+}
+
+// handlePending calls the functions queued by coalesce(), in the order they
+// were first queued.
+func (l *eventLoop) handlePending() {
+	l.m.Lock()
+	pending, order := l.pending, l.order
+	l.pending, l.order = map[string]func(){}, nil
+	l.m.Unlock()
+
+	for _, k := range order {
+		pending[k]()
+	}
+}
+
+// debounce queues fn to be called by the event loop once the characteristic
+// identified by key has been quiet for the quiet period, replacing any function
+// queued for the same characteristic that has not yet been called.
+//
+// It never blocks, regardless of the state of the event loop.
+func (l *eventLoop) debounce(key int, fn func()) {
+	if l.quietPeriod <= 0 {
+		l.coalesce(characteristicKey(key), fn)
+		return
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if d, ok := l.debounced[key]; ok {
+		d.fn = fn
+		d.timer.Reset(l.quietPeriod)
+		return
+	}
+
+	d := &debounced{fn: fn}
+	d.timer = time.AfterFunc(l.quietPeriod, func() {
+		l.flush(key, d)
+	})
+	l.debounced[key] = d
+}
+
+// flush queues the function held back by d to be called by the event loop,
+// if d is still the change being held back for the characteristic identified
+// by key.
+func (l *eventLoop) flush(key int, d *debounced) {
+	l.m.Lock()
+	if l.debounced[key] != d {
+		l.m.Unlock()
+		return
+	}
+	delete(l.debounced, key)
+	l.queue(characteristicKey(key), d.fn)
+	l.m.Unlock()
+
+	l.notify()
+}
+
+// flushAll queues all of the functions held back by debounce() to be called by
+// the event loop, without waiting for their characteristics to be quiet.
+func (l *eventLoop) flushAll() {
+	l.m.Lock()
+	pending := l.debounced
+	l.debounced = map[int]*debounced{}
+
+	keys := make([]int, 0, len(pending))
+	for k, d := range pending {
+		d.timer.Stop()
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	for _, k := range keys {
+		l.queue(characteristicKey(k), pending[k].fn)
+	}
+	l.m.Unlock()
+
+	l.notify()
+}
+
+// characteristicKey returns the key used to queue the changes to the
+// characteristic identified by key.
+func characteristicKey(key int) string {
+	return "characteristic-" + strconv.Itoa(key)
+}
+
+// onLoop returns a function that calls fn on the event loop.
+//
+// It is used to handle HomeKit changes, which are reported on the HomeKit
+// server's goroutines. Rapid changes to the same characteristic are coalesced,
+// such that fn is only called with the final value.
+func onLoop[T any](l *eventLoop, fn func(T)) func(T) {
+	key := l.nextKey
+	l.nextKey++
+
+	return func(v T) {
+		l.debounce(key, func() { fn(v) })
+	}
+}
+
+// onValueUpdate returns a function that handles an update to the value of a
+// characteristic by calling fn with the new value.
+//
+// Updates made by HomeKit are reported on the HomeKit server's goroutines, so
+// fn is called on the event loop, and rapid updates are coalesced as per
+// onLoop(). Updates made by the manager itself are already on the event loop,
+// so fn is called immediately.
+func onValueUpdate[T any](
+	l *eventLoop,
+	fn func(v T, isRemote bool),
+) func(v, _ T, r *http.Request) {
+	key := l.nextKey
+	l.nextKey++
+
+	return func(v, _ T, r *http.Request) {
+		if r == nil {
+			fn(v, false)
+		} else {
+			l.debounce(key, func() { fn(v, true) })
+		}
+	}
+}
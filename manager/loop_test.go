@@ -0,0 +1,256 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestAirConManager_concurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The commands channel is unbuffered so that the event loop is made to
+	// wait on the code that reads the system.
+	commands := make(chan []myplace.Command)
+
+	settings := newTestSettings(t)
+	m := NewAirConManager(settings, commands, newTestSystem(24).AirCons[0], AirConConfig{})
+	a := m.zoneAccessories[0]
+
+	go m.Run(ctx)
+
+	// Read the commands and poll the system in response, as the reconciler
+	// does. This would deadlock if Update() waited for the event loop.
+	go func() {
+		temp := 20.0
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-commands:
+				temp++
+				m.Update(newTestSystem(temp))
+			}
+		}
+	}()
+
+	var g sync.WaitGroup
+
+	// Poll the system in the background, as the reconciler does. The panel's
+	// target temperature is changed such that the manager writes the target
+	// temperature characteristic while HomeKit is writing it. The last poll
+	// has the same target temperature as the polls made in response to
+	// commands.
+	g.Add(1)
+	go func() {
+		defer g.Done()
+
+		for i := 0; i < 100; i++ {
+			sys := newTestSystem(20 + float64(i%10))
+			sys.AirCons[0].Zones[0].TargetTemp = 20 + float64(i%5)
+			m.Update(sys)
+		}
+	}()
+
+	// Make changes in HomeKit via the same lock that the HomeKit server holds
+	// while it handles each request.
+	homeKit := func(c *characteristic.C, v any) {
+		serialize(
+			m.homeKit,
+			http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				c.SetValueRequest(v, &http.Request{})
+			}),
+		).ServeHTTP(nil, &http.Request{})
+	}
+
+	// Each characteristic is written by a single goroutine, as the HomeKit
+	// server itself does not write to the same characteristic concurrently.
+	race := func(c *characteristic.C, values ...any) {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+
+			for i := 0; i < 100; i++ {
+				homeKit(c, values[i%len(values)])
+			}
+		}()
+	}
+
+	race(
+		a.Thermostat.TargetHeatingCoolingState.C,
+		characteristic.TargetHeatingCoolingStateHeat,
+		characteristic.TargetHeatingCoolingStateAuto,
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+	race(a.Thermostat.TargetTemperature.C, 21.0, 22.0, 23.0, 25.0)
+	race(a.CoolingThreshold.C, 26.0, 27.0)
+	race(a.HeatingThreshold.C, 19.0, 20.0)
+	race(m.automation.Switch.On.C, false, true)
+	race(m.overrides.active.On.C, true, false)
+
+	g.Wait()
+
+	// Make the final changes once the polls that change the panel's target
+	// temperature have been made, so that the outcome is deterministic.
+	homeKit(a.Thermostat.TargetHeatingCoolingState.C, characteristic.TargetHeatingCoolingStateHeat)
+	homeKit(a.Thermostat.TargetTemperature.C, 25.0)
+	homeKit(a.CoolingThreshold.C, 27.0)
+	homeKit(a.HeatingThreshold.C, 20.0)
+	homeKit(m.automation.Switch.On.C, true)
+
+	if err := m.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ZoneSettings{
+		TargetState:      characteristic.TargetHeatingCoolingStateHeat,
+		TargetTemp:       25,
+		CoolingThreshold: 27,
+		HeatingThreshold: 20,
+	}
+
+	if *a.Settings != expect {
+		t.Fatalf("unexpected settings: got %+v, want %+v", *a.Settings, expect)
+	}
+
+	if v, _ := settings.Zone("ac1", "z01"); v != expect {
+		t.Fatalf("unexpected saved settings: got %+v, want %+v", v, expect)
+	}
+
+	if !m.isAutomated {
+		t.Fatal("expected automation to be enabled")
+	}
+}
+
+func TestEventLoop_stop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Nothing reads the commands, so the event loop waits as soon as it sends
+	// any.
+	commands := make(chan []myplace.Command)
+
+	sys := newTestSystem(26)
+	sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+	m := NewAirConManager(newTestSettings(t), commands, sys.AirCons[0], AirConConfig{})
+	m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- m.Run(ctx)
+	}()
+
+	m.Update(sys)
+
+	// Fill the queue of HomeKit changes while the loop is waiting to send
+	// the commands.
+	for i := 0; i < eventLoopCapacity; i++ {
+		m.post(func() {})
+	}
+
+	cancel()
+
+	select {
+	case <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event loop to stop")
+	}
+
+	// HomeKit changes made after the loop has stopped must not block.
+	m.automation.Switch.On.SetValueRequest(false, &http.Request{})
+
+	if err := m.Sync(context.Background()); err != context.Canceled {
+		t.Fatalf("unexpected error: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestEventLoop_SetStale(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	commands := make(chan []myplace.Command, 100)
+
+	m := NewAirConManager(newTestSettings(t), commands, newTestSystem(24).AirCons[0], AirConConfig{})
+	a := m.zoneAccessories[0]
+
+	go m.Run(ctx)
+
+	t.Run("it ignores other units", func(t *testing.T) {
+		m.SetStale("ac2", true)
+
+		if err := m.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := a.Fault.Value(); v != characteristic.StatusFaultNoFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultNoFault)
+		}
+	})
+
+	t.Run("it marks the accessories of the unit as faulty", func(t *testing.T) {
+		m.SetStale("ac1", false)
+		m.SetStale("ac1", true)
+
+		if err := m.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := a.Fault.Value(); v != characteristic.StatusFaultGeneralFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultGeneralFault)
+		}
+	})
+}
+
+func TestEventLoop_debounce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("it coalesces rapid changes to a characteristic", func(t *testing.T) {
+		commands := make(chan []myplace.Command, 100)
+
+		sys := newTestSystem(24)
+		m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, time.Hour)
+
+		go m.Run(ctx)
+
+		for _, v := range []float64{20, 21, 22} {
+			m.thermostat.TargetTemperature.SetValueRequest(v, &http.Request{})
+		}
+
+		if err := m.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		expectCommands(t, commands, "set ac1#1 (Living) target temperature to 22.0°C")
+		expectCommands(t, commands)
+	})
+
+	t.Run("it handles a change once the characteristic is quiet", func(t *testing.T) {
+		commands := make(chan []myplace.Command, 100)
+
+		sys := newTestSystem(24)
+		m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, 10*time.Millisecond)
+
+		go m.Run(ctx)
+
+		m.thermostat.TargetTemperature.SetValueRequest(20.0, &http.Request{})
+
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case actual := <-commands:
+			if len(actual) != 1 || actual[0].String() != "set ac1#1 (Living) target temperature to 20.0°C" {
+				t.Fatalf("unexpected commands: %v", actual)
+			}
+		}
+	})
+}
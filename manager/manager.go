@@ -1,13 +1,53 @@
 package manager
 
 import (
+	"context"
+	"sync"
+
 	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
 	"github.com/jmalloc/airkit/myplace"
 )
 
 // AccessoryManager is an interface for managing synchronization of state
 // between homekit accessories and the MyPlace system.
+//
+// Each manager handles HomeKit changes and updates to the MyPlace system's
+// state on its own event loop, which runs until Run() returns.
 type AccessoryManager interface {
+	// Accessories returns the managed accessories.
 	Accessories() []*accessory.A
+
+	// Update records sys as the most recent state of the MyPlace system. It
+	// never blocks.
 	Update(sys *myplace.System)
+
+	// SetStale marks the accessories of the air-conditioning unit with the
+	// given ID as faulty while its state is stale. It never blocks.
+	SetStale(unitID string, isStale bool)
+
+	// WriteFailed reverts any HomeKit changes to the air-conditioning unit
+	// with the given ID that could not be applied to the unit. It never
+	// blocks.
+	WriteFailed(unitID string)
+
+	// Run handles HomeKit changes and state updates until ctx is canceled.
+	Run(ctx context.Context) error
+
+	// Sync blocks until all HomeKit changes and state updates made before it
+	// was called have been handled.
+	Sync(ctx context.Context) error
+
+	// useLock makes the manager hold the given lock while it accesses the
+	// values of its characteristics. It must be called before Run().
+	useLock(lock *sync.Mutex)
+}
+
+// faultStatus returns the value of a "status fault" characteristic.
+func faultStatus(isFault bool) int {
+	if isFault {
+		return characteristic.StatusFaultGeneralFault
+	}
+
+	return characteristic.StatusFaultNoFault
 }
@@ -0,0 +1,188 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+// overrides tracks changes made to an air-conditioning unit by something other
+// than AirKit, such as the wall panel or the MyPlace app.
+//
+// A change is considered to be "manual" if a setting changes between two polls
+// to a value other than the one that AirKit most recently requested, and that
+// the unit has not yet applied.
+type overrides struct {
+	accessory *accessory.A
+	active    *service.Switch
+	fault     *characteristic.StatusFault
+
+	// sent is the value of each setting that AirKit has requested but that has
+	// not yet been seen in a poll, keyed by the setting's name.
+	sent map[string]string
+
+	// unitUntil is the time at which the override of the unit itself expires.
+	unitUntil time.Time
+
+	// zoneUntil is the time at which the override of each zone expires, keyed
+	// by zone ID.
+	zoneUntil map[string]time.Time
+}
+
+// newOverrides returns a new override tracker for the given unit, including
+// the switch accessory that shows whether an override is active.
+func newOverrides(settings *Settings, ac *myplace.AirCon) *overrides {
+	a := accessory.NewSwitch(
+		accessory.Info{
+			Name:         ac.Details.Name + " Manual Override",
+			Manufacturer: "Advantage Air & James Harris",
+			Model:        "MyAir Air Conditioner Manual Override",
+			SerialNumber: ac.ID,
+			Firmware: fmt.Sprintf(
+				"%d.%d",
+				ac.Details.FirmwareMajorVersion,
+				ac.Details.FirmwareMinorVersion,
+			),
+		},
+	)
+	a.Id = settings.airConAccessoryID(ac, acOverrideSwitch)
+
+	f := characteristic.NewStatusFault()
+	a.Switch.AddC(f.C)
+
+	return &overrides{
+		accessory: a.A,
+		active:    a.Switch,
+		fault:     f,
+		sent:      map[string]string{},
+		zoneUntil: map[string]time.Time{},
+	}
+}
+
+// expect records that AirKit has requested a new value for a setting.
+func (o *overrides) expect(setting string, v any) {
+	o.sent[setting] = fmt.Sprint(v)
+}
+
+// isManual returns true if a setting has changed from prev to v, and the new
+// value is not the one that AirKit requested.
+//
+// Once the requested value is seen it is no longer expected, so that a later
+// manual change back to the same value is still detected.
+func (o *overrides) isManual(setting string, prev, v any) bool {
+	p, c := fmt.Sprint(prev), fmt.Sprint(v)
+
+	if s, ok := o.sent[setting]; ok && s == c {
+		delete(o.sent, setting)
+		return false
+	}
+
+	return p != c
+}
+
+// isUnitActive returns true if automation of the unit is paused.
+func (o *overrides) isUnitActive(now time.Time) bool {
+	return now.Before(o.unitUntil)
+}
+
+// isZoneActive returns true if automation of the given zone is paused.
+func (o *overrides) isZoneActive(now time.Time, z *myplace.Zone) bool {
+	return o.isUnitActive(now) || now.Before(o.zoneUntil[z.ID])
+}
+
+// isAnyActive returns true if automation of the unit or any of its zones is
+// paused.
+func (o *overrides) isAnyActive(now time.Time) bool {
+	if o.isUnitActive(now) {
+		return true
+	}
+
+	for _, until := range o.zoneUntil {
+		if now.Before(until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forget discards the values that AirKit has requested, such as when they could
+// not be applied to the unit.
+func (o *overrides) forget() {
+	o.sent = map[string]string{}
+}
+
+// clear removes all overrides.
+func (o *overrides) clear() {
+	o.unitUntil = time.Time{}
+	o.zoneUntil = map[string]time.Time{}
+}
+
+// detectOverrides pauses automation of the unit, or its zones, if their
+// settings have been changed by something other than AirKit.
+func (m *AirConManager) detectOverrides(ac *myplace.AirCon) {
+	if m.config.OverrideDuration == 0 {
+		return
+	}
+
+	o := m.overrides
+	prev := m.ac.Details
+	until := m.now().Add(m.config.OverrideDuration)
+
+	if o.isManual("power", prev.Power, ac.Details.Power) ||
+		o.isManual("mode", prev.Mode, ac.Details.Mode) ||
+		o.isManual("myzone", prev.MyZoneNumber, ac.Details.MyZoneNumber) {
+		log.Printf(
+			"the '%s' air-conditioner was changed outside of AirKit, pausing automation until %s",
+			ac.Details.Name,
+			until.Format(time.Kitchen),
+		)
+		o.unitUntil = until
+	}
+
+	for _, z := range ac.Zones {
+		p, ok := m.ac.ZoneByID[z.ID]
+		if !ok {
+			continue
+		}
+
+		// The unit itself opens constant zones that AirKit has closed, which
+		// must not be mistaken for a manual change. Hidden zones are never
+		// controlled by AirKit, so any change to them is expected.
+		if ac.IsConstantZone(z) || m.config.Zones[z.ID].Hidden {
+			continue
+		}
+
+		// Both settings are checked so that each expectation is cleared once
+		// the requested value is seen.
+		isStateManual := o.isManual("zone-"+z.ID+"-state", p.State, z.State)
+		isTargetManual := o.isManual("zone-"+z.ID+"-target", p.TargetTemp, z.TargetTemp)
+
+		if isStateManual || isTargetManual {
+			log.Printf(
+				"the '%s' zone was changed outside of AirKit, pausing automation of the zone until %s",
+				z.Name,
+				until.Format(time.Kitchen),
+			)
+			o.zoneUntil[z.ID] = until
+		}
+	}
+}
+
+// setOverrideActive handles a change to the "manual override" switch in
+// HomeKit.
+func (m *AirConManager) setOverrideActive(v bool) {
+	if v {
+		m.overrides.unitUntil = m.now().Add(m.config.OverrideDuration)
+	} else {
+		m.overrides.clear()
+	}
+
+	m.apply(false)
+	m.refresh()
+}
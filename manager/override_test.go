@@ -0,0 +1,227 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestAirConManager_manualOverride(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+	now := time.Now()
+
+	sys := newTestSystem(26)
+	sys.AirCons[0].Zones[0].State = myplace.ZoneStateClosed
+
+	m := NewAirConManager(
+		newTestSettings(t),
+		commands,
+		sys.AirCons[0],
+		AirConConfig{
+			OverrideDuration: time.Hour,
+			Now:              func() time.Time { return now },
+		},
+	)
+
+	m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+
+	t.Run("it does not treat its own changes as an override", func(t *testing.T) {
+		m.onUpdate(sys)
+		expectCommands(t, commands, "set ac1#1 (Living) to on")
+
+		sys = newTestSystem(26)
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		if m.overrides.active.On.Value() {
+			t.Fatal("did not expect an override to be active")
+		}
+	})
+
+	t.Run("it pauses automation when the unit is changed manually", func(t *testing.T) {
+		sys = newTestSystem(26)
+		sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		if !m.overrides.active.On.Value() {
+			t.Fatal("expected an override to be active")
+		}
+	})
+
+	t.Run("it resumes automation when the override expires", func(t *testing.T) {
+		now = now.Add(time.Hour)
+
+		m.onUpdate(sys)
+		expectCommands(t, commands, "power ac1 on")
+
+		if m.overrides.active.On.Value() {
+			t.Fatal("did not expect an override to be active")
+		}
+	})
+
+	t.Run("it resumes automation when the override is cleared in HomeKit", func(t *testing.T) {
+		sys = newTestSystem(26)
+		m.onUpdate(sys)
+
+		sys = newTestSystem(26)
+		sys.AirCons[0].Zones[0].State = myplace.ZoneStateClosed
+
+		// The only zone is now controlled manually, so there is nothing left
+		// for the unit to do.
+		m.onUpdate(sys)
+		expectCommands(t, commands, "power ac1 off")
+
+		m.setOverrideActive(false)
+		expectCommands(t, commands, "set ac1#1 (Living) to on")
+	})
+}
+
+func TestAirConManager_manualOverrideReversal(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+	now := time.Now()
+
+	sys := newTestSystem(26)
+	sys.AirCons[0].Details.Power = myplace.AirConPowerOff
+
+	m := NewAirConManager(
+		newTestSettings(t),
+		commands,
+		sys.AirCons[0],
+		AirConConfig{
+			OverrideDuration: time.Hour,
+			Now:              func() time.Time { return now },
+		},
+	)
+
+	m.zoneAccessories[0].Thermostat.TargetHeatingCoolingState.SetValue(
+		characteristic.TargetHeatingCoolingStateCool,
+	)
+
+	m.onUpdate(sys)
+	expectCommands(t, commands, "power ac1 on")
+
+	m.onUpdate(newTestSystem(26))
+	expectCommands(t, commands)
+
+	off := newTestSystem(26)
+	off.AirCons[0].Details.Power = myplace.AirConPowerOff
+	m.onUpdate(off)
+
+	if !m.overrides.active.On.Value() {
+		t.Fatal("expected an override to be active")
+	}
+
+	t.Run("it detects a manual change back to a value that AirKit requested earlier", func(t *testing.T) {
+		now = now.Add(30 * time.Minute)
+		m.onUpdate(newTestSystem(26))
+
+		// The override would have expired by now if it was not extended by
+		// the second manual change.
+		now = now.Add(45 * time.Minute)
+		m.onUpdate(newTestSystem(26))
+		expectCommands(t, commands)
+
+		if !m.overrides.active.On.Value() {
+			t.Fatal("expected an override to be active")
+		}
+	})
+}
+
+func TestAirConManager_manualTargetTempOverride(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+	now := time.Now()
+
+	sys := newTestSystem(26)
+
+	m := NewAirConManager(
+		newTestSettings(t),
+		commands,
+		sys.AirCons[0],
+		AirConConfig{
+			OverrideDuration: time.Hour,
+			Now:              func() time.Time { return now },
+		},
+	)
+
+	a := m.zoneAccessories[0]
+	a.Thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateCool)
+	m.onUpdate(sys)
+	expectCommands(t, commands)
+
+	t.Run("it does not treat its own target temperature changes as an override", func(t *testing.T) {
+		a.Thermostat.TargetTemperature.SetValue(22)
+		m.onZoneChange(a)
+		expectCommands(t, commands, "set ac1#1 (Living) target temperature to 22.0°C")
+
+		sys = newTestSystem(26)
+		sys.AirCons[0].Zones[0].TargetTemp = 22
+		m.onUpdate(sys)
+		expectCommands(t, commands)
+
+		if m.overrides.active.On.Value() {
+			t.Fatal("did not expect an override to be active")
+		}
+	})
+
+	t.Run("it pauses automation of a zone when its target temperature is changed manually", func(t *testing.T) {
+		sys = newTestSystem(26)
+		sys.AirCons[0].Zones[0].TargetTemp = 20
+		m.onUpdate(sys)
+
+		if !m.overrides.active.On.Value() {
+			t.Fatal("expected an override to be active")
+		}
+
+		if !m.overrides.isZoneActive(now, sys.AirCons[0].Zones[0]) {
+			t.Fatal("expected the zone to be overridden")
+		}
+
+		if m.overrides.isUnitActive(now) {
+			t.Fatal("did not expect the unit to be overridden")
+		}
+	})
+}
+
+func TestAirConManager_manualOverrideAfterWriteFailure(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+	now := time.Now()
+
+	sys := newTestSystem(26)
+
+	m := NewAirConManager(
+		newTestSettings(t),
+		commands,
+		sys.AirCons[0],
+		AirConConfig{
+			OverrideDuration: time.Hour,
+			Now:              func() time.Time { return now },
+		},
+	)
+
+	a := m.zoneAccessories[0]
+	a.Thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateCool)
+	m.onUpdate(sys)
+	expectCommands(t, commands)
+
+	a.Thermostat.TargetTemperature.SetValue(22)
+	m.onZoneChange(a)
+	expectCommands(t, commands, "set ac1#1 (Living) target temperature to 22.0°C")
+
+	m.onWriteFailed()
+
+	t.Run("it treats a change to a value that could not be applied as an override", func(t *testing.T) {
+		sys = newTestSystem(26)
+		sys.AirCons[0].Zones[0].TargetTemp = 22
+		m.onUpdate(sys)
+
+		if !m.overrides.active.On.Value() {
+			t.Fatal("expected an override to be active")
+		}
+	})
+}
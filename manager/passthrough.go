@@ -0,0 +1,306 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+// PassthroughManager manages a thermostat accessory that controls an
+// air-conditioning unit directly, and a switch accessory for each of its zones.
+//
+// Unlike AirConManager, it performs no automation of its own. Changes made in
+// HomeKit are sent to the unit as-is, leaving the MyPlace system's own logic
+// (such as MyTemp and MyZone) in charge of the temperature.
+//
+// The manager's state is only accessed by its event loop, which must be started
+// by calling Run().
+type PassthroughManager struct {
+	*eventLoop
+
+	ac           *myplace.AirCon
+	zones        map[string]ZoneConfig
+	isMissing    bool
+	isStale      bool
+	thermostat   *service.Thermostat
+	fault        *characteristic.StatusFault
+	accessories  []*accessory.A
+	zoneSwitches map[string]*service.Switch
+}
+
+// NewPassthroughManager returns a passthrough manager for the given
+// air-conditioning unit.
+//
+// zones is the configuration for specific zones, keyed by zone ID. Only the
+// Hidden, Name, MinTemp and MaxTemp settings are used.
+//
+// Changes made in HomeKit are handled once the characteristic has not been
+// changed for the given quiet period. If it is zero, they are handled
+// immediately.
+func NewPassthroughManager(
+	settings *Settings,
+	commands chan<- []myplace.Command,
+	ac *myplace.AirCon,
+	zones map[string]ZoneConfig,
+	quietPeriod time.Duration,
+) *PassthroughManager {
+	m := &PassthroughManager{
+		ac:           ac,
+		zones:        zones,
+		fault:        characteristic.NewStatusFault(),
+		zoneSwitches: map[string]*service.Switch{},
+	}
+	m.eventLoop = newEventLoop(commands, ac.ID, quietPeriod, m)
+
+	t := accessory.NewThermostat(
+		accessory.Info{
+			Name:         ac.Details.Name,
+			Manufacturer: "Advantage Air & James Harris",
+			Model:        "MyAir Air Conditioner",
+			SerialNumber: ac.ID,
+			Firmware: fmt.Sprintf(
+				"%d.%d",
+				ac.Details.FirmwareMajorVersion,
+				ac.Details.FirmwareMinorVersion,
+			),
+		},
+	)
+	t.Id = settings.airConAccessoryID(ac, acPassthroughThermostat)
+
+	min, max := m.tempLimits()
+	t.Thermostat.TargetTemperature.SetMinValue(min)
+	t.Thermostat.TargetTemperature.SetMaxValue(max)
+	t.Thermostat.TargetTemperature.SetStepValue(1)
+
+	t.Thermostat.CurrentTemperature.SetMinValue(0)
+	t.Thermostat.CurrentTemperature.SetMaxValue(100)
+	t.Thermostat.CurrentTemperature.SetStepValue(0.1)
+
+	t.Thermostat.TargetHeatingCoolingState.OnValueRemoteUpdate(onLoop(m.eventLoop, m.setTargetState))
+	t.Thermostat.TargetTemperature.OnValueRemoteUpdate(onLoop(m.eventLoop, m.setTargetTemp))
+
+	t.Thermostat.AddC(m.fault.C)
+
+	m.thermostat = t.Thermostat
+	m.accessories = append(m.accessories, t.A)
+
+	for _, z := range ac.Zones {
+		z := z // capture loop variable
+
+		if zones[z.ID].Hidden {
+			continue
+		}
+
+		a := accessory.NewSwitch(
+			accessory.Info{
+				Name:         fmt.Sprintf("%s %s", zones[z.ID].displayName(z), ac.Details.Name),
+				Manufacturer: "Advantage Air & James Harris",
+				Model:        "MyAir Zone",
+				SerialNumber: fmt.Sprintf("%s.%s", ac.ID, z.ID),
+				Firmware: fmt.Sprintf(
+					"%d.%d",
+					ac.Details.FirmwareMajorVersion,
+					ac.Details.FirmwareMinorVersion,
+				),
+			},
+		)
+		a.Id = settings.zoneAccessoryID(ac, z, zonePassthroughSwitch)
+
+		a.Switch.On.OnValueRemoteUpdate(
+			onLoop(m.eventLoop, func(v bool) {
+				m.setZoneOpen(z, v)
+			}),
+		)
+
+		m.zoneSwitches[z.ID] = a.Switch
+		m.accessories = append(m.accessories, a.A)
+	}
+
+	m.update(ac)
+
+	return m
+}
+
+// Accessories returns the managed accessories.
+func (m *PassthroughManager) Accessories() []*accessory.A {
+	return m.accessories
+}
+
+// onUpdate updates the accessories to represent the given state.
+//
+// If the unit is missing from s, the thermostat is marked as faulty.
+func (m *PassthroughManager) onUpdate(s *myplace.System) {
+	ac, ok := s.AirConByID[m.ac.ID]
+	m.isMissing = !ok
+
+	if ok {
+		m.update(ac)
+		m.ac = ac
+	}
+
+	m.updateFault()
+}
+
+// onStale handles a change to whether the unit's state is stale.
+func (m *PassthroughManager) onStale(isStale bool) {
+	m.isStale = isStale
+	m.updateFault()
+}
+
+// onWriteFailed handles a failure to apply the commands sent to the unit by
+// reverting the accessories to the unit's most recently read state.
+func (m *PassthroughManager) onWriteFailed() {
+	m.update(m.ac)
+}
+
+// updateFault marks the thermostat as faulty if the unit's state is stale or
+// the unit is missing.
+func (m *PassthroughManager) updateFault() {
+	m.fault.SetValue(faultStatus(m.isStale || m.isMissing))
+}
+
+// update updates the HomeKit accessories to match the air-conditioning unit.
+//
+// Zones that are missing from ac are skipped, as are zones that were not
+// present when the manager was created.
+func (m *PassthroughManager) update(ac *myplace.AirCon) {
+	mode := ac.Details.Mode
+	if mode == myplace.AirConModeAuto {
+		mode = ac.Details.MyAutoMode
+	}
+
+	if ac.Details.Power == myplace.AirConPowerOff {
+		m.thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateOff)
+	} else if ac.Details.Mode == myplace.AirConModeAuto {
+		m.thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateAuto)
+	} else if ac.Details.Mode == myplace.AirConModeHeat {
+		m.thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateHeat)
+	} else if ac.Details.Mode == myplace.AirConModeCool {
+		m.thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateCool)
+	}
+
+	if ac.Details.Power == myplace.AirConPowerOff {
+		m.thermostat.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateOff)
+	} else if mode == myplace.AirConModeHeat {
+		m.thermostat.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateHeat)
+	} else if mode == myplace.AirConModeCool {
+		m.thermostat.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateCool)
+	} else {
+		// unsupported modes are reported as "off"
+		m.thermostat.CurrentHeatingCoolingState.SetValue(characteristic.CurrentHeatingCoolingStateOff)
+	}
+
+	if z, ok := ac.MyZone(); ok {
+		m.thermostat.CurrentTemperature.SetValue(z.CurrentTemp)
+		m.thermostat.TargetTemperature.SetValue(m.clampTemp(z.TargetTemp))
+	} else {
+		m.thermostat.CurrentTemperature.SetValue(averageZoneTemp(ac))
+		m.thermostat.TargetTemperature.SetValue(m.clampTemp(ac.Details.TargetTemp))
+	}
+
+	for _, z := range ac.Zones {
+		if s, ok := m.zoneSwitches[z.ID]; ok {
+			s.On.SetValue(z.State == myplace.ZoneStateOpen)
+		}
+	}
+}
+
+// setTargetState sets the power and mode of the unit.
+func (m *PassthroughManager) setTargetState(v int) {
+	var commands []myplace.Command
+
+	switch v {
+	case characteristic.TargetHeatingCoolingStateOff:
+		commands = append(commands, myplace.SetAirConPower(m.ac.ID, myplace.AirConPowerOff))
+	case characteristic.TargetHeatingCoolingStateHeat:
+		commands = append(commands, myplace.SetAirConMode(m.ac.ID, myplace.AirConModeHeat))
+	case characteristic.TargetHeatingCoolingStateCool:
+		commands = append(commands, myplace.SetAirConMode(m.ac.ID, myplace.AirConModeCool))
+	case characteristic.TargetHeatingCoolingStateAuto:
+		commands = append(commands, myplace.SetAirConMode(m.ac.ID, myplace.AirConModeAuto))
+	}
+
+	if v != characteristic.TargetHeatingCoolingStateOff &&
+		m.ac.Details.Power != myplace.AirConPowerOn {
+		commands = append(commands, myplace.SetAirConPower(m.ac.ID, myplace.AirConPowerOn))
+	}
+
+	m.send(commands)
+}
+
+// setTargetTemp sets the target temperature of the unit's MyZone, or of the
+// unit itself if it has no MyZone.
+func (m *PassthroughManager) setTargetTemp(v float64) {
+	if z, ok := m.ac.MyZone(); ok {
+		v = m.zones[z.ID].clampTemp(v)
+		m.send([]myplace.Command{myplace.SetZoneTargetTemp(m.ac.ID, z, v)})
+	} else {
+		m.send([]myplace.Command{myplace.SetAirConTargetTemp(m.ac.ID, v)})
+	}
+}
+
+// tempLimits returns the range of target temperatures that can be set using
+// the thermostat. It spans the limits of every visible zone, as any of them
+// may be the MyZone.
+func (m *PassthroughManager) tempLimits() (min, max float64) {
+	min, max = DefaultMinTemp, DefaultMaxTemp
+	isFirst := true
+
+	for _, z := range m.ac.Zones {
+		zc := m.zones[z.ID]
+		if zc.Hidden {
+			continue
+		}
+
+		zmin, zmax := zc.tempLimits()
+		if isFirst || zmin < min {
+			min = zmin
+		}
+		if isFirst || zmax > max {
+			max = zmax
+		}
+		isFirst = false
+	}
+
+	return min, max
+}
+
+// clampTemp returns v limited to the thermostat's temperature limits.
+func (m *PassthroughManager) clampTemp(v float64) float64 {
+	min, max := m.tempLimits()
+	return math.Max(min, math.Min(max, v))
+}
+
+// setZoneOpen opens or closes a zone.
+func (m *PassthroughManager) setZoneOpen(z *myplace.Zone, open bool) {
+	if open {
+		m.send([]myplace.Command{myplace.SetZoneState(m.ac.ID, z, myplace.ZoneStateOpen)})
+	} else {
+		m.send([]myplace.Command{myplace.SetZoneState(m.ac.ID, z, myplace.ZoneStateClosed)})
+	}
+}
+
+// averageZoneTemp returns the average temperature of the zones that have a
+// temperature sensor.
+func averageZoneTemp(ac *myplace.AirCon) float64 {
+	var sum float64
+	var count int
+
+	for _, z := range ac.Zones {
+		if z.HasTempControl != 0 && z.Error == myplace.ZoneErrorNone {
+			sum += z.CurrentTemp
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	return sum / float64(count)
+}
@@ -0,0 +1,252 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestPassthroughManager_writeFailed(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+
+	sys := newTestSystem(24)
+	m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, 0)
+
+	m.thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateHeat)
+	m.setTargetState(characteristic.TargetHeatingCoolingStateHeat)
+	expectCommands(t, commands, "set ac1 mode to heat")
+
+	t.Run("it reverts HomeKit changes that could not be applied", func(t *testing.T) {
+		m.onWriteFailed()
+
+		if v := m.thermostat.TargetHeatingCoolingState.Value(); v != characteristic.TargetHeatingCoolingStateCool {
+			t.Fatalf("unexpected target state: got %d, want %d", v, characteristic.TargetHeatingCoolingStateCool)
+		}
+	})
+}
+
+func TestPassthroughManager_stale(t *testing.T) {
+	commands := make(chan []myplace.Command, 100)
+
+	sys := newTestSystem(24)
+	m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, 0)
+
+	t.Run("it marks the thermostat as faulty while the state is stale", func(t *testing.T) {
+		m.onStale(true)
+
+		if v := m.fault.Value(); v != characteristic.StatusFaultGeneralFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultGeneralFault)
+		}
+
+		m.onUpdate(sys)
+
+		if v := m.fault.Value(); v != characteristic.StatusFaultGeneralFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultGeneralFault)
+		}
+	})
+
+	t.Run("it clears the fault once the state is no longer stale", func(t *testing.T) {
+		m.onStale(false)
+
+		if v := m.fault.Value(); v != characteristic.StatusFaultNoFault {
+			t.Fatalf("unexpected fault status: got %d, want %d", v, characteristic.StatusFaultNoFault)
+		}
+	})
+}
+
+func TestPassthroughManager_setTargetState(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Power  myplace.AirConPower
+		State  int
+		Expect []string
+	}{
+		{"off", myplace.AirConPowerOn, characteristic.TargetHeatingCoolingStateOff, []string{"power ac1 off"}},
+		{"heat while on", myplace.AirConPowerOn, characteristic.TargetHeatingCoolingStateHeat, []string{"set ac1 mode to heat"}},
+		{"cool while on", myplace.AirConPowerOn, characteristic.TargetHeatingCoolingStateCool, []string{"set ac1 mode to cool"}},
+		{"auto while on", myplace.AirConPowerOn, characteristic.TargetHeatingCoolingStateAuto, []string{"set ac1 mode to auto"}},
+		{"heat while off", myplace.AirConPowerOff, characteristic.TargetHeatingCoolingStateHeat, []string{"set ac1 mode to heat", "power ac1 on"}},
+		{"cool while off", myplace.AirConPowerOff, characteristic.TargetHeatingCoolingStateCool, []string{"set ac1 mode to cool", "power ac1 on"}},
+		{"auto while off", myplace.AirConPowerOff, characteristic.TargetHeatingCoolingStateAuto, []string{"set ac1 mode to auto", "power ac1 on"}},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			commands := make(chan []myplace.Command, 100)
+
+			sys := newTestSystem(24)
+			sys.AirCons[0].Details.Power = c.Power
+
+			m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, 0)
+			m.setTargetState(c.State)
+
+			expectCommands(t, commands, c.Expect...)
+		})
+	}
+}
+
+func TestPassthroughManager_update(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Power   myplace.AirConPower
+		Mode    myplace.AirConMode
+		Auto    myplace.AirConMode
+		Target  int
+		Current int
+	}{
+		{
+			"off",
+			myplace.AirConPowerOff,
+			myplace.AirConModeHeat,
+			"",
+			characteristic.TargetHeatingCoolingStateOff,
+			characteristic.CurrentHeatingCoolingStateOff,
+		},
+		{
+			"heating",
+			myplace.AirConPowerOn,
+			myplace.AirConModeHeat,
+			"",
+			characteristic.TargetHeatingCoolingStateHeat,
+			characteristic.CurrentHeatingCoolingStateHeat,
+		},
+		{
+			"cooling",
+			myplace.AirConPowerOn,
+			myplace.AirConModeCool,
+			"",
+			characteristic.TargetHeatingCoolingStateCool,
+			characteristic.CurrentHeatingCoolingStateCool,
+		},
+		{
+			"auto while heating",
+			myplace.AirConPowerOn,
+			myplace.AirConModeAuto,
+			myplace.AirConModeHeat,
+			characteristic.TargetHeatingCoolingStateAuto,
+			characteristic.CurrentHeatingCoolingStateHeat,
+		},
+		{
+			"auto while cooling",
+			myplace.AirConPowerOn,
+			myplace.AirConModeAuto,
+			myplace.AirConModeCool,
+			characteristic.TargetHeatingCoolingStateAuto,
+			characteristic.CurrentHeatingCoolingStateCool,
+		},
+		{
+			"unsupported mode keeps the previous target state",
+			myplace.AirConPowerOn,
+			myplace.AirConModeVent,
+			"",
+			characteristic.TargetHeatingCoolingStateCool,
+			characteristic.CurrentHeatingCoolingStateOff,
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			commands := make(chan []myplace.Command, 100)
+
+			sys := newTestSystem(24)
+			m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, 0)
+
+			sys = newTestSystem(24)
+			sys.AirCons[0].Details.Power = c.Power
+			sys.AirCons[0].Details.Mode = c.Mode
+			sys.AirCons[0].Details.MyAutoMode = c.Auto
+			m.onUpdate(sys)
+
+			if v := m.thermostat.TargetHeatingCoolingState.Value(); v != c.Target {
+				t.Fatalf("unexpected target state: got %d, want %d", v, c.Target)
+			}
+
+			if v := m.thermostat.CurrentHeatingCoolingState.Value(); v != c.Current {
+				t.Fatalf("unexpected current state: got %d, want %d", v, c.Current)
+			}
+
+			expectCommands(t, commands)
+		})
+	}
+}
+
+func TestPassthroughManager_setTargetTemp(t *testing.T) {
+	t.Run("it sets the target temperature of the MyZone", func(t *testing.T) {
+		commands := make(chan []myplace.Command, 100)
+
+		sys := newTestSystem(24)
+		m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, 0)
+
+		if v := m.thermostat.TargetTemperature.Value(); v != 24 {
+			t.Fatalf("unexpected target temperature: got %.1f, want 24.0", v)
+		}
+
+		m.setTargetTemp(21)
+		expectCommands(t, commands, "set ac1#1 (Living) target temperature to 21.0°C")
+	})
+
+	t.Run("it sets the target temperature of the unit if there is no MyZone", func(t *testing.T) {
+		commands := make(chan []myplace.Command, 100)
+
+		sys := newTestSystem(24)
+		sys.AirCons[0].Details.MyZoneNumber = 0
+		sys.AirCons[0].Details.TargetTemp = 23
+
+		m := NewPassthroughManager(newTestSettings(t), commands, sys.AirCons[0], nil, 0)
+
+		if v := m.thermostat.TargetTemperature.Value(); v != 23 {
+			t.Fatalf("unexpected target temperature: got %.1f, want 23.0", v)
+		}
+
+		m.setTargetTemp(21)
+		expectCommands(t, commands, "set ac1 target temperature to 21.0°C")
+	})
+}
+
+func TestPassthroughManager_tempLimits(t *testing.T) {
+	t.Run("it uses the default limits if no zones are configured", func(t *testing.T) {
+		sys := newTestSystem(24)
+		m := NewPassthroughManager(newTestSettings(t), make(chan []myplace.Command, 100), sys.AirCons[0], nil, 0)
+
+		tt := m.thermostat.TargetTemperature
+		if tt.MinValue() != DefaultMinTemp || tt.MaxValue() != DefaultMaxTemp {
+			t.Fatalf("unexpected limits: got %.1f - %.1f, want %d - %d", tt.MinValue(), tt.MaxValue(), DefaultMinTemp, DefaultMaxTemp)
+		}
+	})
+
+	t.Run("it uses the limits of the zone configuration", func(t *testing.T) {
+		commands := make(chan []myplace.Command, 100)
+
+		sys := newTestSystem(24)
+		m := NewPassthroughManager(
+			newTestSettings(t),
+			commands,
+			sys.AirCons[0],
+			map[string]ZoneConfig{
+				"z01": {MinTemp: 18, MaxTemp: 26},
+			},
+			0,
+		)
+
+		tt := m.thermostat.TargetTemperature
+		if tt.MinValue() != 18 || tt.MaxValue() != 26 {
+			t.Fatalf("unexpected limits: got %.1f - %.1f, want 18.0 - 26.0", tt.MinValue(), tt.MaxValue())
+		}
+
+		m.setTargetTemp(30)
+		expectCommands(t, commands, "set ac1#1 (Living) target temperature to 26.0°C")
+
+		sys = newTestSystem(24)
+		sys.AirCons[0].Zones[0].TargetTemp = 16
+		m.onUpdate(sys)
+
+		if v := tt.Value(); v != 18 {
+			t.Fatalf("unexpected target temperature: got %.1f, want 18.0", v)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package manager
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/brutella/hap"
+	"github.com/go-chi/chi"
+)
+
+// SerializeRequests makes srv handle each request while holding a lock that
+// the given managers also hold while they update the values of
+// characteristics.
+//
+// The HomeKit server reads and writes the values of characteristics without any
+// synchronization, so the managers must not share accessories with any other
+// server.
+//
+// It must be called before srv starts serving requests and before the managers
+// are run.
+func SerializeRequests(srv *hap.Server, managers []AccessoryManager) error {
+	// The server's handler can not be replaced, so its routes are wrapped
+	// instead. Re-registering a route replaces its handler, along with any
+	// middleware that applied to it, so the existing handlers are wrapped
+	// rather than replaced.
+	router, ok := srv.ServeMux().(chi.Router)
+	if !ok {
+		return errors.New("the HomeKit server's routes can not be wrapped")
+	}
+
+	lock := &sync.Mutex{}
+
+	for _, m := range managers {
+		m.useLock(lock)
+	}
+
+	for _, r := range router.Routes() {
+		for method, h := range r.Handlers {
+			if method == "*" {
+				router.Handle(r.Pattern, serialize(lock, h))
+			} else {
+				router.Method(method, r.Pattern, serialize(lock, h))
+			}
+		}
+	}
+
+	return nil
+}
+
+// serialize returns a handler that calls h while holding the given lock.
+func serialize(lock *sync.Mutex, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		h.ServeHTTP(w, r)
+	})
+}
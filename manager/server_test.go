@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestSerializeRequests(t *testing.T) {
+	a := accessory.NewBridge(accessory.Info{Name: "Test"})
+
+	srv, err := hap.NewServer(hap.NewMemStore(), a.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewFanManager(
+		newTestSettings(t),
+		make(chan []myplace.Command, 100),
+		newTestSystem(24).AirCons[0],
+		0,
+	)
+
+	if err := SerializeRequests(srv, []AccessoryManager{m}); err != nil {
+		t.Fatal(err)
+	}
+
+	isLocked := false
+	a.IdentifyFunc = func(*http.Request) {
+		if m.homeKit.TryLock() {
+			m.homeKit.Unlock()
+		} else {
+			isLocked = true
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeMux().(http.Handler).ServeHTTP(
+		w,
+		httptest.NewRequest(http.MethodPost, "/identify", nil),
+	)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: got %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	if !isLocked {
+		t.Fatal("expected the request to be handled while holding the HomeKit lock")
+	}
+}
@@ -0,0 +1,306 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brutella/hap"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+// Settings is a persistent store of the settings made via HomeKit, such as
+// zone modes and target temperatures, and of the IDs allocated to each HomeKit
+// accessory.
+//
+// The settings are kept in the same hap.Store as the HomeKit pairing
+// information, so that they survive restarts even if the MyPlace system never
+// applied them.
+type Settings struct {
+	store hap.Store
+
+	m            sync.Mutex
+	accessoryIDs map[string]uint64
+}
+
+// ZoneSettings is the HomeKit-side state of a single zone.
+type ZoneSettings struct {
+	// TargetState is the zone's HomeKit "target heating/cooling state".
+	TargetState int `json:"targetState"`
+
+	// TargetTemp is the zone's HomeKit target temperature, or zero if it is
+	// unknown.
+	TargetTemp float64 `json:"targetTemp,omitempty"`
+
+	// CoolingThreshold and HeatingThreshold are the upper and lower bounds of
+	// the zone's comfort band in AUTO mode, or zero if they are unknown.
+	CoolingThreshold float64 `json:"coolingThreshold,omitempty"`
+	HeatingThreshold float64 `json:"heatingThreshold,omitempty"`
+}
+
+// AirConSettings is the HomeKit-side state of an air-conditioning unit.
+type AirConSettings struct {
+	// AutomationDisabled is true if AirKit has been prevented from operating
+	// the unit.
+	AutomationDisabled bool `json:"automationDisabled,omitempty"`
+}
+
+// FanSettings is the HomeKit-side state of an air-conditioning unit's fan.
+type FanSettings struct {
+	// PrevSpeed is the fan speed to use when the fan speed override is turned
+	// on.
+	PrevSpeed myplace.FanSpeed `json:"prevSpeed"`
+}
+
+// NewSettings returns the settings kept in the given store.
+//
+// The settings are migrated to the latest format if necessary.
+func NewSettings(store hap.Store) (*Settings, error) {
+	s := &Settings{store: store}
+
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("unable to migrate settings: %w", err)
+	}
+
+	if err := s.loadAccessoryIDs(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Zone returns the settings for the given zone.
+func (s *Settings) Zone(acID, zoneID string) (ZoneSettings, bool) {
+	var v ZoneSettings
+	ok := s.load(zoneSettingsKey(acID, zoneID), &v)
+	return v, ok
+}
+
+// SetZone saves the settings for the given zone.
+func (s *Settings) SetZone(acID, zoneID string, v ZoneSettings) error {
+	return s.save(zoneSettingsKey(acID, zoneID), v)
+}
+
+// AirCon returns the settings for the given air-conditioning unit.
+func (s *Settings) AirCon(acID string) (AirConSettings, bool) {
+	var v AirConSettings
+	ok := s.load(airConSettingsKey(acID), &v)
+	return v, ok
+}
+
+// SetAirCon saves the settings for the given air-conditioning unit.
+func (s *Settings) SetAirCon(acID string, v AirConSettings) error {
+	return s.save(airConSettingsKey(acID), v)
+}
+
+// Fan returns the settings for the given air-conditioning unit's fan.
+func (s *Settings) Fan(acID string) (FanSettings, bool) {
+	var v FanSettings
+	ok := s.load(fanSettingsKey(acID), &v)
+	return v, ok
+}
+
+// SetFan saves the settings for the given air-conditioning unit's fan.
+func (s *Settings) SetFan(acID string, v FanSettings) error {
+	return s.save(fanSettingsKey(acID), v)
+}
+
+// load unmarshals the value stored under the given key into v.
+func (s *Settings) load(key string, v any) bool {
+	ok, err := getValue(s.store, key, func(data []byte) error {
+		return json.Unmarshal(data, v)
+	})
+
+	return ok && err == nil
+}
+
+// save marshals v and stores it under the given key.
+func (s *Settings) save(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return setValue(s.store, key, data)
+}
+
+// settingsVersionKey is the key under which the version of the settings format
+// is stored.
+const settingsVersionKey = "airkit-settings-version"
+
+// settingsMigrations is the sequence of changes that have been made to the
+// format of the settings. The migration at index i upgrades the settings from
+// version i to version i+1.
+//
+// Migrations must never be removed or reordered, new migrations are appended
+// to the end.
+var settingsMigrations = []func(hap.Store) error{
+	migrateLegacyZoneKeys,
+}
+
+// migrate upgrades the settings to the latest format.
+func (s *Settings) migrate() error {
+	version := 0
+
+	if _, err := getValue(s.store, settingsVersionKey, func(data []byte) (err error) {
+		version, err = strconv.Atoi(string(data))
+		return err
+	}); err != nil {
+		return fmt.Errorf("invalid settings version: %w", err)
+	}
+
+	if version > len(settingsMigrations) {
+		return fmt.Errorf(
+			"the settings are from a newer version of AirKit (version %d, expected %d or earlier)",
+			version,
+			len(settingsMigrations),
+		)
+	}
+
+	for ; version < len(settingsMigrations); version++ {
+		if err := settingsMigrations[version](s.store); err != nil {
+			return fmt.Errorf("unable to upgrade from version %d: %w", version, err)
+		}
+
+		if err := setValue(
+			s.store,
+			settingsVersionKey,
+			[]byte(strconv.Itoa(version+1)),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacyZoneKeys moves the zone target states that were previously
+// kept in separate "myplace-<ac>-<zone>-target-state" keys into the settings
+// value of each zone.
+func migrateLegacyZoneKeys(store hap.Store) error {
+	const suffix = "-target-state"
+
+	keys, err := store.KeysWithSuffix(suffix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "myplace-") {
+			continue
+		}
+
+		ids := strings.TrimSuffix(strings.TrimPrefix(key, "myplace-"), suffix)
+		acID, zoneID, ok := strings.Cut(ids, "-")
+		if !ok {
+			continue
+		}
+
+		data, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+
+		// Merge the target state into any existing settings for the zone,
+		// such as its threshold temperatures.
+		var v ZoneSettings
+		settingsKey := zoneSettingsKey(acID, zoneID)
+		if _, err := getValue(store, settingsKey, func(data []byte) error {
+			return json.Unmarshal(data, &v)
+		}); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", settingsKey, err)
+		}
+
+		v.TargetState, err = strconv.Atoi(string(data))
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+
+		data, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		if err := setValue(store, settingsKey, data); err != nil {
+			return err
+		}
+
+		// Only remove the legacy key once the new value has been written, so
+		// that an interrupted migration can be retried.
+		store.Delete(key)
+	}
+
+	return nil
+}
+
+// zoneSettingsKey returns the key under which a zone's settings are stored.
+func zoneSettingsKey(acID, zoneID string) string {
+	return fmt.Sprintf("zone-%s-%s.settings", acID, zoneID)
+}
+
+// airConSettingsKey returns the key under which an air-conditioning unit's
+// settings are stored.
+func airConSettingsKey(acID string) string {
+	return fmt.Sprintf("aircon-%s.settings", acID)
+}
+
+// fanSettingsKey returns the key under which a fan's settings are stored.
+func fanSettingsKey(acID string) string {
+	return fmt.Sprintf("fan-%s.settings", acID)
+}
+
+// setValue stores a value in the store, replacing any existing value.
+//
+// The filesystem-based store does not truncate existing files, so the existing
+// value must be deleted before the new value is written in case the new value
+// is shorter. A copy of the new value is written under a backup key first, so
+// that getValue can recover it if AirKit stops before the value itself has
+// been written in full.
+func setValue(store hap.Store, key string, data []byte) error {
+	backup := backupKey(key)
+
+	store.Delete(backup)
+	if err := store.Set(backup, data); err != nil {
+		return err
+	}
+
+	store.Delete(key)
+	if err := store.Set(key, data); err != nil {
+		return err
+	}
+
+	return store.Delete(backup)
+}
+
+// getValue passes the value stored under the given key to parse.
+//
+// If the value is missing or parse fails, it falls back to the backup left
+// behind by an interrupted call to setValue. ok is false if neither value
+// exists, otherwise err is the error returned by parse, if any.
+func getValue(store hap.Store, key string, parse func([]byte) error) (ok bool, err error) {
+	for _, k := range []string{key, backupKey(key)} {
+		data, getErr := store.Get(k)
+		if getErr != nil {
+			continue
+		}
+
+		parseErr := parse(data)
+		if parseErr == nil {
+			return true, nil
+		}
+
+		if !ok {
+			ok, err = true, parseErr
+		}
+	}
+
+	return ok, err
+}
+
+// backupKey returns the key under which setValue keeps a copy of a value while
+// it is being replaced.
+func backupKey(key string) string {
+	return key + ".backup"
+}
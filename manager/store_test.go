@@ -0,0 +1,154 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/characteristic"
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestSettings_migrateLegacyZoneKeys(t *testing.T) {
+	st := hap.NewMemStore()
+	st.Set("myplace-ac1-z01-target-state", []byte("3"))
+	st.Set("zone-ac1-z01.settings", []byte(`{"targetState":0,"coolingThreshold":26}`))
+	st.Set("myplace-ac1-z02-target-state", []byte("1"))
+
+	s, err := NewSettings(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.Zone("ac1", "z01"); !ok {
+		t.Fatal("expected settings for z01")
+	} else if v != (ZoneSettings{TargetState: 3, CoolingThreshold: 26}) {
+		t.Fatalf("unexpected settings for z01: %+v", v)
+	}
+
+	if v, ok := s.Zone("ac1", "z02"); !ok {
+		t.Fatal("expected settings for z02")
+	} else if v != (ZoneSettings{TargetState: 1}) {
+		t.Fatalf("unexpected settings for z02: %+v", v)
+	}
+
+	keys, err := st.KeysWithSuffix("-target-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 0 {
+		t.Fatalf("expected legacy keys to be removed, got %v", keys)
+	}
+
+	// Ensure the migration is not re-applied to new values that happen to
+	// match the legacy key format.
+	st.Set("myplace-ac1-z01-target-state", []byte("0"))
+
+	s, err = NewSettings(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := s.Zone("ac1", "z01"); v.TargetState != 3 {
+		t.Fatalf("migration was re-applied: %+v", v)
+	}
+}
+
+func TestSettings_newerVersion(t *testing.T) {
+	st := hap.NewMemStore()
+	st.Set(settingsVersionKey, []byte("1000"))
+
+	if _, err := NewSettings(st); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSettings_interruptedWrite(t *testing.T) {
+	t.Run("it recovers a value that was not written in full", func(t *testing.T) {
+		st := hap.NewMemStore()
+		st.Set(backupKey("zone-ac1-z01.settings"), []byte(`{"targetState":2,"targetTemp":21}`))
+		st.Set("zone-ac1-z01.settings", []byte(`{"targetState":2,"tar`))
+
+		s, err := NewSettings(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, ok := s.Zone("ac1", "z01"); !ok {
+			t.Fatal("expected settings for z01")
+		} else if v != (ZoneSettings{TargetState: 2, TargetTemp: 21}) {
+			t.Fatalf("unexpected settings for z01: %+v", v)
+		}
+	})
+
+	t.Run("it recovers a value that was deleted but not rewritten", func(t *testing.T) {
+		st := hap.NewMemStore()
+		st.Set(backupKey("aircon-ac1.settings"), []byte(`{"automationDisabled":true}`))
+
+		s, err := NewSettings(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, ok := s.AirCon("ac1"); !ok || !v.AutomationDisabled {
+			t.Fatalf("unexpected settings for ac1: %+v", v)
+		}
+	})
+
+	t.Run("it removes the backup once the value has been written", func(t *testing.T) {
+		st := hap.NewMemStore()
+
+		s, err := NewSettings(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetZone("ac1", "z01", ZoneSettings{TargetState: 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := st.KeysWithSuffix(".backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 0 {
+			t.Fatalf("expected backups to be removed, got %v", keys)
+		}
+	})
+}
+
+func TestAirConManager_restoresSettings(t *testing.T) {
+	settings := newTestSettings(t)
+	commands := make(chan []myplace.Command, 100)
+
+	sys := newTestSystem(24)
+	m := NewAirConManager(settings, commands, sys.AirCons[0], AirConConfig{})
+
+	a := m.zoneAccessories[0]
+	a.Thermostat.TargetHeatingCoolingState.SetValue(characteristic.TargetHeatingCoolingStateCool)
+	a.Thermostat.TargetTemperature.SetValue(22)
+	m.saveZone(a)
+
+	// The panel still has the old target temperature, as if the restart
+	// occurred before the change was applied.
+	sys = newTestSystem(24)
+	m = NewAirConManager(settings, commands, sys.AirCons[0], AirConConfig{})
+
+	a = m.zoneAccessories[0]
+	if v := a.Thermostat.TargetHeatingCoolingState.Value(); v != characteristic.TargetHeatingCoolingStateCool {
+		t.Fatalf("unexpected target state: got %d", v)
+	}
+
+	m.onUpdate(sys)
+
+	if v := a.Thermostat.TargetTemperature.Value(); v != 22 {
+		t.Fatalf("unexpected target temperature: got %v, want 22", v)
+	}
+
+	expectCommands(
+		t,
+		commands,
+		"set ac1#1 (Living) target temperature to 22.0°C",
+	)
+}
@@ -0,0 +1,266 @@
+package manager
+
+import (
+	"fmt"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+// ControlStrategy is an algorithm that decides how an air-conditioning unit is
+// operated in order to satisfy the HomeKit settings of its zones.
+type ControlStrategy interface {
+	// TargetMode returns the desired power and mode for the air-conditioning
+	// unit.
+	TargetMode(d Demand) (myplace.AirConPower, myplace.AirConMode)
+
+	// PartitionZones returns two sets of zones, containing the zones that must
+	// be opened, and closed, respectively.
+	PartitionZones(d Demand, isCooling bool) (open, closed []ZoneDemand)
+
+	// SelectMyZone returns the best zone to use as the MyZone.
+	//
+	// open is the set of zones that are to be opened, as returned by
+	// PartitionZones().
+	SelectMyZone(d Demand, isCooling bool, open []ZoneDemand) (ZoneDemand, bool)
+}
+
+// Demand describes the state of an air-conditioning unit and the HomeKit
+// settings of each of its zones.
+type Demand struct {
+	AirCon *myplace.AirCon
+	Zones  []ZoneDemand
+}
+
+// ZoneDemand describes the state of a zone and its HomeKit settings.
+type ZoneDemand struct {
+	Zone         *myplace.Zone
+	CurrentTemp  float64
+	TargetTemp   float64
+	AllowCooling bool
+	AllowHeating bool
+	Thresholds   Thresholds
+
+	// CoolTarget and HeatTarget are the temperatures to which the zone is
+	// cooled and heated, respectively.
+	//
+	// They are both equal to TargetTemp, unless the zone allows both heating
+	// and cooling, in which case they are the upper and lower bounds of the
+	// zone's comfort band.
+	CoolTarget float64
+	HeatTarget float64
+
+	// NeedsCooling and NeedsHeating indicate whether the zone is calling for
+	// cooling or heating, respectively, taking the zone's thresholds and
+	// previous demand into account.
+	//
+	// They are only ever true if the zone allows the corresponding mode.
+	NeedsCooling bool
+	NeedsHeating bool
+}
+
+// CoolDelta returns the difference between the zone's current temperature and
+// the temperature it is cooled to. It is positive if the zone is warmer than
+// its target.
+func (z ZoneDemand) CoolDelta() float64 {
+	return z.CurrentTemp - z.CoolTarget
+}
+
+// HeatDelta returns the difference between the zone's current temperature and
+// the temperature it is heated to. It is negative if the zone is cooler than
+// its target.
+func (z ZoneDemand) HeatDelta() float64 {
+	return z.CurrentTemp - z.HeatTarget
+}
+
+const (
+	// FavourCoolingStrategy is the name of the FavourCooling strategy.
+	FavourCoolingStrategy = "favour-cooling"
+
+	// MajorityDemandStrategy is the name of the MajorityDemand strategy.
+	MajorityDemandStrategy = "majority-demand"
+)
+
+// NewControlStrategy returns the control strategy with the given name.
+func NewControlStrategy(name string) (ControlStrategy, error) {
+	switch name {
+	case FavourCoolingStrategy:
+		return FavourCooling{}, nil
+	case MajorityDemandStrategy:
+		return MajorityDemand{}, nil
+	default:
+		return nil, fmt.Errorf(
+			"unknown control strategy (%s), expected %s or %s",
+			name,
+			FavourCoolingStrategy,
+			MajorityDemandStrategy,
+		)
+	}
+}
+
+// FavourCooling is a ControlStrategy that always favours cooling over
+// heating. That is, if any zone requires cooling, the entire unit will be
+// switched to cool and must reach temperature before the unit will be switched
+// to heat.
+type FavourCooling struct{}
+
+// TargetMode returns the desired power and mode for the air-conditioning
+// unit.
+func (FavourCooling) TargetMode(d Demand) (myplace.AirConPower, myplace.AirConMode) {
+	var needsHeating bool
+
+	for _, z := range d.Zones {
+		if z.NeedsCooling {
+			return myplace.AirConPowerOn, myplace.AirConModeCool
+		}
+
+		if z.NeedsHeating {
+			needsHeating = true
+		}
+	}
+
+	if needsHeating {
+		return myplace.AirConPowerOn, myplace.AirConModeHeat
+	}
+
+	return myplace.AirConPowerOff, d.AirCon.Details.Mode
+}
+
+// PartitionZones returns two sets of zones, containing the zones that must be
+// opened, and closed, respectively.
+func (FavourCooling) PartitionZones(d Demand, isCooling bool) (open, closed []ZoneDemand) {
+	return partitionZonesByMode(d, isCooling)
+}
+
+// SelectMyZone returns the best zone to use as the MyZone.
+func (FavourCooling) SelectMyZone(d Demand, isCooling bool, open []ZoneDemand) (ZoneDemand, bool) {
+	return selectMyZoneByDelta(isCooling, open)
+}
+
+// MajorityDemand is a ControlStrategy that heats or cools depending on which
+// mode is required by the most zones, weighted by how far each zone is from its
+// target temperature.
+//
+// If the zones' demands for heating and cooling are equal, the unit remains in
+// its current mode.
+type MajorityDemand struct{}
+
+// TargetMode returns the desired power and mode for the air-conditioning
+// unit.
+func (MajorityDemand) TargetMode(d Demand) (myplace.AirConPower, myplace.AirConMode) {
+	var cool, heat float64
+
+	for _, z := range d.Zones {
+		// Weight each zone by how far it is from the point at which it would
+		// stop calling for heating or cooling.
+		if z.NeedsCooling {
+			cool += z.CoolDelta() + z.Thresholds.CoolStop
+		}
+
+		if z.NeedsHeating {
+			heat += z.Thresholds.HeatStop - z.HeatDelta()
+		}
+	}
+
+	switch {
+	case cool == 0 && heat == 0:
+		return myplace.AirConPowerOff, d.AirCon.Details.Mode
+	case cool > heat:
+		return myplace.AirConPowerOn, myplace.AirConModeCool
+	case heat > cool:
+		return myplace.AirConPowerOn, myplace.AirConModeHeat
+	case d.AirCon.Details.Mode == myplace.AirConModeHeat:
+		return myplace.AirConPowerOn, myplace.AirConModeHeat
+	default:
+		return myplace.AirConPowerOn, myplace.AirConModeCool
+	}
+}
+
+// PartitionZones returns two sets of zones, containing the zones that must be
+// opened, and closed, respectively.
+func (MajorityDemand) PartitionZones(d Demand, isCooling bool) (open, closed []ZoneDemand) {
+	return partitionZonesByMode(d, isCooling)
+}
+
+// SelectMyZone returns the best zone to use as the MyZone.
+func (MajorityDemand) SelectMyZone(d Demand, isCooling bool, open []ZoneDemand) (ZoneDemand, bool) {
+	return selectMyZoneByDelta(isCooling, open)
+}
+
+// partitionZonesByMode opens each zone that is calling for the unit's current
+// mode, and closes all others.
+//
+// If no zones are calling for the current mode, such as when the unit is kept
+// running by compressor protection, the zones that allow the current mode are
+// opened instead, so that the unit still has somewhere to send air.
+func partitionZonesByMode(d Demand, isCooling bool) (open, closed []ZoneDemand) {
+	needs := func(z ZoneDemand) bool {
+		if isCooling {
+			return z.NeedsCooling
+		}
+		return z.NeedsHeating
+	}
+
+	allows := func(z ZoneDemand) bool {
+		if isCooling {
+			return z.AllowCooling
+		}
+		return z.AllowHeating
+	}
+
+	predicate := allows
+	for _, z := range d.Zones {
+		if needs(z) {
+			predicate = needs
+			break
+		}
+	}
+
+	for _, z := range d.Zones {
+		if predicate(z) {
+			open = append(open, z)
+		} else {
+			closed = append(closed, z)
+		}
+	}
+
+	return open, closed
+}
+
+// selectMyZoneByDelta selects the open zone that is furthest from its target
+// temperature in the direction of the unit's current mode.
+func selectMyZoneByDelta(isCooling bool, zones []ZoneDemand) (ZoneDemand, bool) {
+	var (
+		my  ZoneDemand
+		ok  bool
+		max float64
+	)
+
+	for _, z := range zones {
+		// Don't consider the zone a candidate for MyZone if we don't even want
+		// it on.
+		if z.Zone.State != myplace.ZoneStateOpen {
+			continue
+		}
+
+		// Don't consider the zone a candidate for MyZone if we can't measure
+		// the temperature.
+		if z.Zone.Error == myplace.ZoneErrorNoSignal {
+			continue
+		}
+
+		delta := z.CoolDelta()
+
+		// if we're not cooling, favour the lowest delta (ie, current < target)
+		if !isCooling {
+			delta = -z.HeatDelta()
+		}
+
+		if !ok || delta > max {
+			my = z
+			ok = true
+			max = delta
+		}
+	}
+
+	return my, ok
+}
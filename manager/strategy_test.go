@@ -0,0 +1,317 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestFavourCooling_TargetMode(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Zones []ZoneDemand
+		Power myplace.AirConPower
+		Mode  myplace.AirConMode
+	}{
+		{
+			"no demand",
+			[]ZoneDemand{{}, {}},
+			myplace.AirConPowerOff,
+			myplace.AirConModeVent,
+		},
+		{
+			"cooling and heating demand",
+			[]ZoneDemand{{NeedsHeating: true}, {NeedsCooling: true}},
+			myplace.AirConPowerOn,
+			myplace.AirConModeCool,
+		},
+		{
+			"heating demand only",
+			[]ZoneDemand{{NeedsHeating: true}, {}},
+			myplace.AirConPowerOn,
+			myplace.AirConModeHeat,
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			ac := &myplace.AirCon{}
+			ac.Details.Mode = myplace.AirConModeVent
+
+			power, mode := FavourCooling{}.TargetMode(Demand{ac, c.Zones})
+
+			if power != c.Power || mode != c.Mode {
+				t.Fatalf("unexpected result: got %s/%s, want %s/%s", power, mode, c.Power, c.Mode)
+			}
+		})
+	}
+}
+
+func TestMajorityDemand_TargetMode(t *testing.T) {
+	th := Thresholds{
+		CoolStart: 0.5,
+		CoolStop:  0.5,
+		HeatStart: 0.5,
+		HeatStop:  0.5,
+	}
+
+	cool := func(delta float64) ZoneDemand {
+		return ZoneDemand{
+			CurrentTemp:  24 + delta,
+			TargetTemp:   24,
+			CoolTarget:   24,
+			HeatTarget:   24,
+			Thresholds:   th,
+			NeedsCooling: true,
+		}
+	}
+
+	heat := func(delta float64) ZoneDemand {
+		return ZoneDemand{
+			CurrentTemp:  24 + delta,
+			TargetTemp:   24,
+			CoolTarget:   24,
+			HeatTarget:   24,
+			Thresholds:   th,
+			NeedsHeating: true,
+		}
+	}
+
+	cases := []struct {
+		Name    string
+		Current myplace.AirConMode
+		Zones   []ZoneDemand
+		Power   myplace.AirConPower
+		Mode    myplace.AirConMode
+	}{
+		{
+			"no demand",
+			myplace.AirConModeHeat,
+			[]ZoneDemand{{}, {}},
+			myplace.AirConPowerOff,
+			myplace.AirConModeHeat,
+		},
+		{
+			"more cooling demand",
+			myplace.AirConModeHeat,
+			[]ZoneDemand{cool(2), heat(-1)},
+			myplace.AirConPowerOn,
+			myplace.AirConModeCool,
+		},
+		{
+			"more heating demand",
+			myplace.AirConModeCool,
+			[]ZoneDemand{cool(1), heat(-1), heat(-1)},
+			myplace.AirConPowerOn,
+			myplace.AirConModeHeat,
+		},
+		{
+			"equal demand keeps current mode",
+			myplace.AirConModeHeat,
+			[]ZoneDemand{cool(1.5), heat(-1.5)},
+			myplace.AirConPowerOn,
+			myplace.AirConModeHeat,
+		},
+		{
+			"equal demand keeps current cooling mode",
+			myplace.AirConModeCool,
+			[]ZoneDemand{cool(1.5), heat(-1.5)},
+			myplace.AirConPowerOn,
+			myplace.AirConModeCool,
+		},
+		{
+			"equal demand cools when neither heating nor cooling",
+			myplace.AirConModeVent,
+			[]ZoneDemand{cool(1.5), heat(-1.5)},
+			myplace.AirConPowerOn,
+			myplace.AirConModeCool,
+		},
+		{
+			"demand is weighted by distance from the stop threshold",
+			myplace.AirConModeCool,
+			[]ZoneDemand{cool(0.5), cool(0.5), heat(-2.5)},
+			myplace.AirConPowerOn,
+			myplace.AirConModeHeat,
+		},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			ac := &myplace.AirCon{}
+			ac.Details.Mode = c.Current
+
+			power, mode := MajorityDemand{}.TargetMode(Demand{ac, c.Zones})
+
+			if power != c.Power || mode != c.Mode {
+				t.Fatalf("unexpected result: got %s/%s, want %s/%s", power, mode, c.Power, c.Mode)
+			}
+		})
+	}
+}
+
+// strategies is the set of all control strategies.
+var strategies = []struct {
+	Name     string
+	Strategy ControlStrategy
+}{
+	{FavourCoolingStrategy, FavourCooling{}},
+	{MajorityDemandStrategy, MajorityDemand{}},
+}
+
+func TestControlStrategy_PartitionZones(t *testing.T) {
+	z1 := &myplace.Zone{Number: 1}
+	z2 := &myplace.Zone{Number: 2}
+	z3 := &myplace.Zone{Number: 3}
+
+	d := Demand{
+		AirCon: &myplace.AirCon{},
+		Zones: []ZoneDemand{
+			{Zone: z1, AllowCooling: true, NeedsCooling: true},
+			{Zone: z2, AllowCooling: true, AllowHeating: true, NeedsHeating: true},
+			{Zone: z3, AllowHeating: true},
+		},
+	}
+
+	for _, x := range strategies {
+		x := x // capture loop variable
+
+		t.Run(x.Name, func(t *testing.T) {
+			t.Run("it opens the zones that need cooling while cooling", func(t *testing.T) {
+				open, closed := x.Strategy.PartitionZones(d, true)
+
+				expectZones(t, "open", open, z1)
+				expectZones(t, "closed", closed, z2, z3)
+			})
+
+			t.Run("it opens the zones that need heating while heating", func(t *testing.T) {
+				open, closed := x.Strategy.PartitionZones(d, false)
+
+				expectZones(t, "open", open, z2)
+				expectZones(t, "closed", closed, z1, z3)
+			})
+		})
+	}
+}
+
+func TestControlStrategy_SelectMyZone(t *testing.T) {
+	zone := func(n uint8, temp float64) ZoneDemand {
+		return ZoneDemand{
+			Zone: &myplace.Zone{
+				Number: n,
+				State:  myplace.ZoneStateOpen,
+			},
+			CurrentTemp: temp,
+			TargetTemp:  22,
+			CoolTarget:  22,
+			HeatTarget:  22,
+		}
+	}
+
+	warm, warmer, cool, cooler := zone(1, 24), zone(2, 26), zone(3, 20), zone(4, 18)
+
+	closed := zone(5, 30)
+	closed.Zone.State = myplace.ZoneStateClosed
+
+	noSignal := zone(6, 30)
+	noSignal.Zone.Error = myplace.ZoneErrorNoSignal
+
+	cases := []struct {
+		Name      string
+		IsCooling bool
+		Open      []ZoneDemand
+		Expect    *myplace.Zone
+	}{
+		{"cooling selects the warmest zone", true, []ZoneDemand{warm, warmer, cool}, warmer.Zone},
+		{"heating selects the coolest zone", false, []ZoneDemand{warm, cool, cooler}, cooler.Zone},
+		{"closed zones are not selected", true, []ZoneDemand{warm, closed}, warm.Zone},
+		{"zones without a signal are not selected", true, []ZoneDemand{warm, noSignal}, warm.Zone},
+		{"ties select the first zone", true, []ZoneDemand{warm, zone(7, 24)}, warm.Zone},
+		{"no candidates", true, []ZoneDemand{closed, noSignal}, nil},
+	}
+
+	for _, x := range strategies {
+		x := x // capture loop variable
+
+		t.Run(x.Name, func(t *testing.T) {
+			for _, c := range cases {
+				c := c // capture loop variable
+
+				t.Run(c.Name, func(t *testing.T) {
+					d := Demand{AirCon: &myplace.AirCon{}, Zones: c.Open}
+					my, ok := x.Strategy.SelectMyZone(d, c.IsCooling, c.Open)
+
+					if c.Expect == nil {
+						if ok {
+							t.Fatalf("did not expect a zone, got #%d", my.Zone.Number)
+						}
+						return
+					}
+
+					if !ok {
+						t.Fatalf("expected zone #%d", c.Expect.Number)
+					}
+
+					if my.Zone != c.Expect {
+						t.Fatalf("unexpected zone: got #%d, want #%d", my.Zone.Number, c.Expect.Number)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestPartitionZonesByMode(t *testing.T) {
+	z1 := &myplace.Zone{Number: 1}
+	z2 := &myplace.Zone{Number: 2}
+	z3 := &myplace.Zone{Number: 3}
+
+	t.Run("it opens zones that are calling for the current mode", func(t *testing.T) {
+		open, closed := partitionZonesByMode(
+			Demand{
+				Zones: []ZoneDemand{
+					{Zone: z1, AllowCooling: true, NeedsCooling: true},
+					{Zone: z2, AllowCooling: true},
+					{Zone: z3, AllowHeating: true, NeedsHeating: true},
+				},
+			},
+			true,
+		)
+
+		expectZones(t, "open", open, z1)
+		expectZones(t, "closed", closed, z2, z3)
+	})
+
+	t.Run("it opens zones that allow the current mode if no zones are calling for it", func(t *testing.T) {
+		open, closed := partitionZonesByMode(
+			Demand{
+				Zones: []ZoneDemand{
+					{Zone: z1, AllowCooling: true},
+					{Zone: z2, AllowHeating: true},
+					{Zone: z3, AllowCooling: true, AllowHeating: true},
+				},
+			},
+			false,
+		)
+
+		expectZones(t, "open", open, z2, z3)
+		expectZones(t, "closed", closed, z1)
+	})
+}
+
+func expectZones(t *testing.T, desc string, actual []ZoneDemand, expect ...*myplace.Zone) {
+	t.Helper()
+
+	if len(actual) != len(expect) {
+		t.Fatalf("unexpected number of %s zones: got %d, want %d", desc, len(actual), len(expect))
+	}
+
+	for i, z := range actual {
+		if z.Zone != expect[i] {
+			t.Fatalf("unexpected %s zone at index %d: got #%d, want #%d", desc, i, z.Zone.Number, expect[i].Number)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package manager
+
+import "fmt"
+
+// Thresholds controls when a zone calls for heating or cooling, relative to its
+// target temperature.
+//
+// Separate "start" and "stop" thresholds provide a deadband around the target
+// temperature. A zone that is calling for cooling continues to do so until it
+// is cooled past the stop threshold, and does not call for cooling again until
+// it warms past the start threshold.
+type Thresholds struct {
+	// CoolStart is the amount (in °C) by which a zone's temperature must
+	// exceed its target before it calls for cooling.
+	CoolStart float64
+
+	// CoolStop is the amount (in °C) by which a zone's temperature must fall
+	// below its target before it stops calling for cooling.
+	CoolStop float64
+
+	// HeatStart is the amount (in °C) by which a zone's temperature must fall
+	// below its target before it calls for heating.
+	HeatStart float64
+
+	// HeatStop is the amount (in °C) by which a zone's temperature must exceed
+	// its target before it stops calling for heating.
+	HeatStop float64
+}
+
+// DefaultThresholds is the set of thresholds used when none are configured.
+//
+// They have no deadband, matching the behaviour of AirKit before the thresholds
+// were configurable.
+//
+// A zone calls for cooling unless it is at least 0.1°C below its target
+// temperature. This is an attempt to let the AC regulate the temperature, only
+// switching the unit off if the AC is over-cooling.
+//
+// A zone calls for heating only while it is more than 0.5°C below its target
+// temperature, so heating stops before the target is reached. This is an
+// attempt to avoid continually switching between heating and cooling when
+// zones are set to AUTO. In general, we favour cooling over heating.
+var DefaultThresholds = Thresholds{
+	CoolStart: -0.1,
+	CoolStop:  0.1,
+	HeatStart: 0.5,
+	HeatStop:  -0.5,
+}
+
+// Validate returns an error if the thresholds do not form a valid deadband.
+func (t Thresholds) Validate() error {
+	if t.CoolStart+t.CoolStop < 0 {
+		return fmt.Errorf(
+			"cooling would stop (%+.1f°C) before it starts (%+.1f°C)",
+			-t.CoolStop,
+			t.CoolStart,
+		)
+	}
+
+	if t.HeatStart+t.HeatStop < 0 {
+		return fmt.Errorf(
+			"heating would stop (%+.1f°C) before it starts (%+.1f°C)",
+			t.HeatStop,
+			-t.HeatStart,
+		)
+	}
+
+	return nil
+}
+
+// Cooling returns true if a zone calls for cooling.
+//
+// delta is the difference between the zone's current temperature and the
+// temperature it is being cooled to. wasCooling is the result of the previous
+// call for the same zone.
+func (t Thresholds) Cooling(delta float64, wasCooling bool) bool {
+	if wasCooling {
+		return delta > -t.CoolStop
+	}
+
+	return delta > t.CoolStart
+}
+
+// Heating returns true if a zone calls for heating.
+//
+// delta is the difference between the zone's current temperature and the
+// temperature it is being heated to. wasHeating is the result of the previous
+// call for the same zone.
+func (t Thresholds) Heating(delta float64, wasHeating bool) bool {
+	if wasHeating {
+		return delta < t.HeatStop
+	}
+
+	return delta < -t.HeatStart
+}
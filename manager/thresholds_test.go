@@ -0,0 +1,110 @@
+package manager
+
+import "testing"
+
+func TestThresholds_CoolingAndHeating(t *testing.T) {
+	th := Thresholds{
+		CoolStart: 0.5,
+		CoolStop:  0.3,
+		HeatStart: 1.0,
+		HeatStop:  0.2,
+	}
+
+	cases := []struct {
+		Name       string
+		Delta      float64
+		WasCooling bool
+		WasHeating bool
+		Cool       bool
+		Heat       bool
+	}{
+		{"idle, at target", 0, false, false, false, false},
+		{"idle, within cooling deadband", 0.5, false, false, false, false},
+		{"idle, above cooling start threshold", 0.6, false, false, true, false},
+		{"cooling, below target but above stop threshold", -0.2, true, false, true, false},
+		{"cooling, at stop threshold", -0.3, true, false, false, false},
+		{"cooling, below stop threshold", -0.4, true, false, false, false},
+		{"idle, within heating deadband", -1.0, false, false, false, false},
+		{"idle, below heating start threshold", -1.1, false, false, false, true},
+		{"heating, above target but below stop threshold", 0.1, false, true, false, true},
+		{"heating, at stop threshold", 0.2, false, true, false, false},
+		{"heating, above stop threshold", 0.3, false, true, false, false},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			cool := th.Cooling(c.Delta, c.WasCooling)
+			heat := th.Heating(c.Delta, c.WasHeating)
+
+			if cool != c.Cool {
+				t.Errorf("unexpected cooling demand: got %t, want %t", cool, c.Cool)
+			}
+
+			if heat != c.Heat {
+				t.Errorf("unexpected heating demand: got %t, want %t", heat, c.Heat)
+			}
+		})
+	}
+}
+
+func TestDefaultThresholds(t *testing.T) {
+	cases := []struct {
+		Delta float64
+		Cool  bool
+		Heat  bool
+	}{
+		{1.0, true, false},
+		{-0.05, true, false},
+		{-0.1, false, false},
+		{-0.5, false, false},
+		{-0.6, false, true},
+	}
+
+	for _, c := range cases {
+		// The defaults have no deadband, so the result is the same regardless
+		// of whether the zone was already heating or cooling.
+		for _, was := range []bool{false, true} {
+			if cool := DefaultThresholds.Cooling(c.Delta, was); cool != c.Cool {
+				t.Errorf("unexpected cooling demand at %+.2f°C (was cooling: %t): got %t, want %t", c.Delta, was, cool, c.Cool)
+			}
+
+			if heat := DefaultThresholds.Heating(c.Delta, was); heat != c.Heat {
+				t.Errorf("unexpected heating demand at %+.2f°C (was heating: %t): got %t, want %t", c.Delta, was, heat, c.Heat)
+			}
+		}
+	}
+}
+
+func TestThresholds_Validate(t *testing.T) {
+	if err := DefaultThresholds.Validate(); err != nil {
+		t.Fatalf("default thresholds are invalid: %s", err)
+	}
+
+	cases := []struct {
+		Name       string
+		Thresholds Thresholds
+		Valid      bool
+	}{
+		{"no deadband", Thresholds{CoolStart: -0.1, CoolStop: 0.1, HeatStart: 0.5, HeatStop: -0.5}, true},
+		{"cooling stops before it starts", Thresholds{CoolStart: -0.2, CoolStop: 0.1}, false},
+		{"heating stops before it starts", Thresholds{HeatStart: 0.5, HeatStop: -0.6}, false},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			err := c.Thresholds.Validate()
+
+			if c.Valid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !c.Valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+const (
+	// DefaultMinTemp is the lowest target temperature that can be set in
+	// HomeKit, unless overridden by ZoneConfig.MinTemp.
+	DefaultMinTemp = 16
+
+	// DefaultMaxTemp is the highest target temperature that can be set in
+	// HomeKit, unless overridden by ZoneConfig.MaxTemp.
+	DefaultMaxTemp = 32
+
+	// MinComfortBand is the smallest difference between the heating and
+	// cooling threshold temperatures of a zone in AUTO mode.
+	MinComfortBand = 1
+)
+
+// ZoneConfig is the configuration for a specific zone.
+type ZoneConfig struct {
+	// Hidden excludes the zone from HomeKit. AirKit never opens or closes a
+	// hidden zone.
+	Hidden bool
+
+	// Name overrides the name of the zone as configured in the MyPlace
+	// system.
+	Name string
+
+	// MinTemp and MaxTemp limit the target temperature that can be set in
+	// HomeKit. Zero values use DefaultMinTemp and DefaultMaxTemp,
+	// respectively.
+	MinTemp float64
+	MaxTemp float64
+
+	// CalibrationOffset is added to the temperature measured by the zone's
+	// sensor.
+	CalibrationOffset float64
+
+	// Thresholds overrides AirConConfig.Thresholds for this zone.
+	Thresholds *Thresholds
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c ZoneConfig) Validate() error {
+	min, max := c.tempLimits()
+
+	if min < DefaultMinTemp || min > DefaultMaxTemp ||
+		max < DefaultMinTemp || max > DefaultMaxTemp {
+		return fmt.Errorf(
+			"the temperature limits (%.1f°C - %.1f°C) must be within %d°C - %d°C",
+			min,
+			max,
+			DefaultMinTemp,
+			DefaultMaxTemp,
+		)
+	}
+
+	if max-min < MinComfortBand {
+		return fmt.Errorf(
+			"the minimum temperature (%.1f°C) must be at least %d°C less than the maximum temperature (%.1f°C)",
+			min,
+			MinComfortBand,
+			max,
+		)
+	}
+
+	if c.Thresholds != nil {
+		if err := c.Thresholds.Validate(); err != nil {
+			return fmt.Errorf("the temperature thresholds are invalid: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// displayName returns the name to use for z in HomeKit.
+func (c ZoneConfig) displayName(z *myplace.Zone) string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	return z.Name
+}
+
+// tempLimits returns the range of target temperatures that can be set in
+// HomeKit.
+func (c ZoneConfig) tempLimits() (min, max float64) {
+	min, max = c.MinTemp, c.MaxTemp
+
+	if min == 0 {
+		min = DefaultMinTemp
+	}
+
+	if max == 0 {
+		max = DefaultMaxTemp
+	}
+
+	return min, max
+}
+
+// clampTemp returns v limited to the zone's temperature limits.
+func (c ZoneConfig) clampTemp(v float64) float64 {
+	min, max := c.tempLimits()
+	return math.Max(min, math.Min(max, v))
+}
+
+// clampBand returns the heating and cooling threshold temperatures limited to
+// the zone's temperature limits, such that heat is at least MinComfortBand
+// below cool.
+//
+// If they are too close together, the threshold given by keep is left as it
+// is, and the other is moved away from it, unless that would take it beyond
+// the zone's limits.
+func (c ZoneConfig) clampBand(heat, cool float64, keep bandEnd) (float64, float64) {
+	min, max := c.tempLimits()
+	heat, cool = c.clampTemp(heat), c.clampTemp(cool)
+
+	if cool-heat >= MinComfortBand {
+		return heat, cool
+	}
+
+	if keep == heatingEnd {
+		cool = math.Min(max, heat+MinComfortBand)
+		return cool - MinComfortBand, cool
+	}
+
+	heat = math.Max(min, cool-MinComfortBand)
+	return heat, heat + MinComfortBand
+}
+
+// bandEnd is an enumeration of the ends of a zone's comfort band.
+type bandEnd int
+
+const (
+	// heatingEnd is the lower end of the band, set by the heating threshold.
+	heatingEnd bandEnd = iota
+
+	// coolingEnd is the upper end of the band, set by the cooling threshold.
+	coolingEnd
+)
@@ -0,0 +1,51 @@
+package manager
+
+import "testing"
+
+func TestZoneConfig_clampBand(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Heat, Cool float64
+		Keep       bandEnd
+		ExpectHeat float64
+		ExpectCool float64
+	}{
+		{"valid band", 20, 24, heatingEnd, 20, 24},
+		{"narrowest band", 20, 21, coolingEnd, 20, 21},
+		{"inverted band, keeping the heating threshold", 24, 20, heatingEnd, 24, 25},
+		{"inverted band, keeping the cooling threshold", 24, 20, coolingEnd, 19, 20},
+		{"equal thresholds, keeping the heating threshold", 22, 22, heatingEnd, 22, 23},
+		{"equal thresholds, keeping the cooling threshold", 22, 22, coolingEnd, 21, 22},
+		{"heating threshold at the maximum", 32, 32, heatingEnd, 31, 32},
+		{"cooling threshold at the minimum", 16, 16, coolingEnd, 16, 17},
+		{"thresholds beyond the limits", 40, 10, heatingEnd, 31, 32},
+	}
+
+	for _, c := range cases {
+		c := c // capture loop variable
+
+		t.Run(c.Name, func(t *testing.T) {
+			heat, cool := ZoneConfig{}.clampBand(c.Heat, c.Cool, c.Keep)
+
+			if heat != c.ExpectHeat || cool != c.ExpectCool {
+				t.Fatalf(
+					"unexpected band: got %.1f°C - %.1f°C, want %.1f°C - %.1f°C",
+					heat,
+					cool,
+					c.ExpectHeat,
+					c.ExpectCool,
+				)
+			}
+		})
+	}
+}
+
+func TestZoneConfig_Validate(t *testing.T) {
+	t.Run("it rejects temperature limits that are closer than the comfort band", func(t *testing.T) {
+		c := ZoneConfig{MinTemp: 20, MaxTemp: 20.5}
+
+		if err := c.Validate(); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
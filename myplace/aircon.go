@@ -2,6 +2,7 @@ package myplace
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -109,10 +110,12 @@ type AirCon struct {
 	ID      string `json:"-"`
 	Number  uint8  `json:"-"`
 	Details struct {
+		UID                  string      `json:"uid,omitempty"`
 		Name                 string      `json:"name,omitempty"`
 		FanSpeed             FanSpeed    `json:"fan,omitempty"`
 		Mode                 AirConMode  `json:"mode,omitempty"`
 		Power                AirConPower `json:"state,omitempty"`
+		TargetTemp           float64     `json:"setTemp,omitempty"`
 		FilterStatus         int         `json:"filterCleanStatus,omitempty"`
 		MyFanEnabled         bool        `json:"aaAutoFanModeEnabled,omitempty"`
 		MyTempEnabled        bool        `json:"climateControlModeEnabled,omitempty"`
@@ -133,25 +136,64 @@ type AirCon struct {
 	Zones    []*Zone          `json:"-"`
 }
 
-func (ac *AirCon) populate(id string) {
+func (ac *AirCon) populate(id string) error {
 	n, err := strconv.ParseUint(strings.TrimPrefix(id, "ac"), 10, 8)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("invalid air-conditioning unit ID (%s): %w", id, err)
 	}
 
 	ac.ID = id
 	ac.Number = uint8(n)
-	ac.Zones = make([]*Zone, len(ac.ZoneByID))
+	ac.Zones = make([]*Zone, 0, len(ac.ZoneByID))
 
-	for id, z := range ac.ZoneByID {
-		z.populate(id)
-		ac.Zones[z.Number-1] = z
+	// The zone list may be sparse, such as when a zone's sensor has not been
+	// reporting, so zone numbers are not assumed to be contiguous.
+	for zid, z := range ac.ZoneByID {
+		if z == nil {
+			return fmt.Errorf("%s zone %s has no data", id, zid)
+		}
+
+		z.populate(zid)
+
+		if z.Number == 0 {
+			return fmt.Errorf("%s zone %s has an invalid zone number (%d)", id, zid, z.Number)
+		}
+
+		ac.Zones = append(ac.Zones, z)
+	}
+
+	sort.Slice(ac.Zones, func(i, j int) bool {
+		return ac.Zones[i].Number < ac.Zones[j].Number
+	})
+
+	for i := 1; i < len(ac.Zones); i++ {
+		if x, z := ac.Zones[i-1], ac.Zones[i]; x.Number == z.Number {
+			return fmt.Errorf("%s zones %s and %s have the same zone number (%d)", id, x.ID, z.ID, z.Number)
+		}
+	}
+
+	return nil
+}
+
+// ZoneByNumber returns the zone with the given zone number, if it is present.
+func (ac *AirCon) ZoneByNumber(n uint8) (*Zone, bool) {
+	if n == 0 {
+		return nil, false
+	}
+
+	for _, z := range ac.Zones {
+		if z.Number == n {
+			return z, true
+		}
 	}
+
+	return nil, false
 }
 
-// MyZone returns the currently selected "MyZone".
-func (ac *AirCon) MyZone() *Zone {
-	return ac.Zones[ac.Details.MyZoneNumber-1]
+// MyZone returns the currently selected "MyZone", if the unit has one and it is
+// present.
+func (ac *AirCon) MyZone() (*Zone, bool) {
+	return ac.ZoneByNumber(ac.Details.MyZoneNumber)
 }
 
 // IsMyZone returns true if z is the current MyZone.
@@ -163,16 +205,14 @@ func (ac *AirCon) IsMyZone(z *Zone) bool {
 func (ac *AirCon) ConstantZones() []*Zone {
 	var zones []*Zone
 
-	if ac.Details.ConstantZone1Number != 0 {
-		zones = append(zones, ac.Zones[ac.Details.ConstantZone1Number-1])
-	}
-
-	if ac.Details.ConstantZone2Number != 0 {
-		zones = append(zones, ac.Zones[ac.Details.ConstantZone2Number-1])
-	}
-
-	if ac.Details.ConstantZone3Number != 0 {
-		zones = append(zones, ac.Zones[ac.Details.ConstantZone3Number-1])
+	for _, n := range []uint8{
+		ac.Details.ConstantZone1Number,
+		ac.Details.ConstantZone2Number,
+		ac.Details.ConstantZone3Number,
+	} {
+		if z, ok := ac.ZoneByNumber(n); ok {
+			zones = append(zones, z)
+		}
 	}
 
 	return zones
@@ -241,3 +281,24 @@ func SetFanSpeed(id string, v FanSpeed) Command {
 		},
 	}
 }
+
+// SetAirConTargetTemp returns a command that sets the target temperature of an
+// air-conditioning unit.
+//
+// The unit's target temperature is only used when the MyZone feature is
+// disabled.
+func SetAirConTargetTemp(id string, v float64) Command {
+	return Command{
+		desc: fmt.Sprintf("set %s target temperature to %.1f°C", id, v),
+		apply: func(req map[string]*AirCon) {
+			ac, ok := req[id]
+
+			if !ok {
+				ac = &AirCon{}
+				req[id] = ac
+			}
+
+			ac.Details.TargetTemp = v
+		},
+	}
+}
@@ -0,0 +1,54 @@
+package myplace
+
+import (
+	"encoding/json"
+)
+
+// Changes returns the values that the command sets, keyed by their path within
+// the system, such as "ac1.zones.z01.state".
+func (c Command) Changes() map[string]any {
+	req := map[string]*AirCon{}
+	c.apply(req)
+	return flatten(req)
+}
+
+// Values returns the values of the settings of every air-conditioning unit in
+// the system, keyed by the same paths as Command.Changes().
+func (s *System) Values() map[string]any {
+	return flatten(s.AirConByID)
+}
+
+// flatten returns the leaf values of the JSON representation of v, keyed by
+// their dot-separated path.
+func flatten(v any) map[string]any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err) // the data model always marshals successfully
+	}
+
+	var tree map[string]any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		panic(err)
+	}
+
+	values := map[string]any{}
+	flattenInto(values, "", tree)
+
+	return values
+}
+
+// flattenInto adds the leaf values of tree to values, prefixing each path with
+// prefix.
+func flattenInto(values map[string]any, prefix string, tree map[string]any) {
+	for k, v := range tree {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+
+		if t, ok := v.(map[string]any); ok {
+			flattenInto(values, k, t)
+		} else {
+			values[k] = v
+		}
+	}
+}
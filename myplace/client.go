@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -15,14 +16,30 @@ const DefaultPort = "2025"
 
 // A Command is a request to change the state of the system in some way.
 type Command struct {
-	desc  string
-	apply func(map[string]*AirCon)
+	desc         string
+	apply        func(map[string]*AirCon)
+	isBestEffort bool
 }
 
 func (c Command) String() string {
 	return c.desc
 }
 
+// BestEffort returns a copy of c that the system is permitted to ignore, such
+// as a request to close a zone that the system keeps open.
+//
+// A best-effort command is sent once. It is not retried if the system does not
+// reflect it, nor is that treated as a failure.
+func (c Command) BestEffort() Command {
+	c.isBestEffort = true
+	return c
+}
+
+// IsBestEffort returns true if the system is permitted to ignore c.
+func (c Command) IsBestEffort() bool {
+	return c.isBestEffort
+}
+
 // Client is a client for the MyPlace API.
 type Client struct {
 	// Host is the hostname of the API server. It must not be empty.
@@ -40,16 +57,25 @@ type Client struct {
 
 // Read fetches the state of the entire system.
 func (c *Client) Read(ctx context.Context) (*System, error) {
+	data, err := c.ReadRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSystem(data)
+}
+
+// ReadRaw fetches the state of the entire system as the raw JSON document
+// returned by the API server.
+func (c *Client) ReadRaw(ctx context.Context) ([]byte, error) {
 	for {
-		res, err := c.get(ctx, "/getSystemData", nil)
+		data, err := c.readRaw(ctx)
 		if err != nil {
 			return nil, err
 		}
-		defer res.Body.Close()
 
 		var s System
-
-		if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		if err := json.Unmarshal(data, &s); err != nil {
 			return nil, err
 		}
 
@@ -66,20 +92,24 @@ func (c *Client) Read(ctx context.Context) (*System, error) {
 			}
 		}
 
-		s.populate()
+		return data, nil
+	}
+}
 
-		return &s, nil
+// readRaw performs a single request for the state of the entire system.
+func (c *Client) readRaw(ctx context.Context) ([]byte, error) {
+	res, err := c.get(ctx, "/getSystemData", nil)
+	if err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
+
+	return io.ReadAll(res.Body)
 }
 
 // Write updates the state of the system by performing one or more commands.
 func (c *Client) Write(ctx context.Context, commands ...Command) error {
-	req := map[string]*AirCon{}
-	for _, c := range commands {
-		c.apply(req)
-	}
-
-	buf, err := json.Marshal(req)
+	buf, err := MarshalCommands(commands...)
 	if err != nil {
 		return err
 	}
@@ -114,6 +144,17 @@ func (c *Client) Write(ctx context.Context, commands ...Command) error {
 	return errors.New(result.Reason)
 }
 
+// MarshalCommands returns the JSON representation of the request that is sent
+// to the API server in order to perform the given commands.
+func MarshalCommands(commands ...Command) ([]byte, error) {
+	req := map[string]*AirCon{}
+	for _, c := range commands {
+		c.apply(req)
+	}
+
+	return json.Marshal(req)
+}
+
 // get performs an HTTP GET request.
 func (c *Client) get(
 	ctx context.Context,
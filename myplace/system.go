@@ -1,6 +1,10 @@
 package myplace
 
-import "sort"
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
 
 // System represents the entire system.
 type System struct {
@@ -15,9 +19,31 @@ type System struct {
 	AirConByID map[string]*AirCon `json:"aircons,omitempty"`
 }
 
-func (s *System) populate() {
+// ParseSystem parses the JSON representation of the entire system, as
+// returned by the "/getSystemData" API endpoint.
+func ParseSystem(data []byte) (*System, error) {
+	var s System
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	if err := s.populate(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (s *System) populate() error {
 	for id, ac := range s.AirConByID {
-		ac.populate(id)
+		if ac == nil {
+			return fmt.Errorf("air-conditioning unit %s has no data", id)
+		}
+
+		if err := ac.populate(id); err != nil {
+			return err
+		}
+
 		s.AirCons = append(s.AirCons, ac)
 	}
 
@@ -27,4 +53,6 @@ func (s *System) populate() {
 			return s.AirCons[i].ID < s.AirCons[j].ID
 		},
 	)
+
+	return nil
 }
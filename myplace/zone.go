@@ -141,3 +141,33 @@ func SetZoneTargetTemp(id string, zone *Zone, v float64) Command {
 		},
 	}
 }
+
+// SetZoneDamperPercentage returns a command that sets how far a zone's damper
+// is opened.
+func SetZoneDamperPercentage(id string, zone *Zone, v int) Command {
+	return Command{
+		desc: fmt.Sprintf("set %s#%d (%s) damper to %d%%", id, zone.Number, zone.Name, v),
+		apply: func(req map[string]*AirCon) {
+			ac, ok := req[id]
+
+			if !ok {
+				ac = &AirCon{}
+				req[id] = ac
+			}
+
+			z, ok := ac.ZoneByID[zone.ID]
+
+			if !ok {
+				z = &Zone{}
+
+				if ac.ZoneByID == nil {
+					ac.ZoneByID = map[string]*Zone{}
+				}
+
+				ac.ZoneByID[zone.ID] = z
+			}
+
+			z.DamperPercentage = v
+		},
+	}
+}
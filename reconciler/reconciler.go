@@ -0,0 +1,774 @@
+// Package reconciler keeps the state of a MyPlace system in line with the
+// state requested by AirKit.
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+const (
+	// DefaultPollInterval is the default interval at which the MyPlace system
+	// is read.
+	DefaultPollInterval = 2 * time.Second
+
+	// DefaultFastPollInterval is the default interval at which the MyPlace
+	// system is read while it is converging on the desired state.
+	DefaultFastPollInterval = 1 * time.Second
+
+	// DefaultIdlePollInterval is the default interval at which the MyPlace
+	// system is read while it is idle.
+	DefaultIdlePollInterval = 15 * time.Second
+
+	// DefaultIdleAfter is the default amount of time without any writes or
+	// refresh requests after which the MyPlace system is considered idle.
+	DefaultIdleAfter = 5 * time.Minute
+
+	// DefaultMaxPollBackoff is the default maximum interval between attempts
+	// to read the MyPlace system when it is returning errors.
+	DefaultMaxPollBackoff = 1 * time.Minute
+
+	// DefaultRetryInterval is the default amount of time to wait for the
+	// MyPlace system to reflect a command before sending it again.
+	DefaultRetryInterval = 10 * time.Second
+
+	// DefaultMaxAttempts is the default number of times a command is sent
+	// before the reconciler gives up on it.
+	DefaultMaxAttempts = 3
+
+	// DefaultMaxBatchSize is the default maximum number of commands sent in a
+	// single request.
+	DefaultMaxBatchSize = 20
+
+	// DefaultStaleAfter is the default amount of time after which the state
+	// of an air-conditioning unit is considered stale if it can not be read
+	// or written.
+	DefaultStaleAfter = 2 * time.Minute
+)
+
+// Client is the interface used to read from and write to the MyPlace system.
+//
+// It is implemented by *myplace.Client.
+type Client interface {
+	ReadRaw(ctx context.Context) ([]byte, error)
+	Write(ctx context.Context, commands ...myplace.Command) error
+}
+
+// Clock is a source of time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Reconciler reads the actual state of a MyPlace system and sends the commands
+// necessary to bring it in line with the desired state.
+//
+// The desired state is the combined effect of the commands received from the
+// accessory managers. Each command is sent only if the most recent read shows
+// that the system does not already reflect it, and is sent again if the system
+// does not reflect it within RetryInterval. Commands that change the same
+// setting replace each other, so only the most recent is sent.
+//
+// A command that is abandoned after MaxAttempts is not sent again until a
+// command that changes the same settings to a different value is received.
+// Best-effort commands are abandoned as soon as they are sent, and are never
+// reported as failures.
+type Reconciler struct {
+	// Client is the client used to read from and write to the MyPlace system.
+	Client Client
+
+	// Commands is the channel on which commands describing the desired state
+	// are received.
+	Commands <-chan []myplace.Command
+
+	// Clock is the source of time. If it is nil, the system clock is used.
+	Clock Clock
+
+	// PollInterval is the interval at which the MyPlace system is read. If it
+	// is zero, DefaultPollInterval is used.
+	PollInterval time.Duration
+
+	// FastPollInterval is the interval at which the MyPlace system is read
+	// while there are commands that it does not yet reflect. If it is zero,
+	// DefaultFastPollInterval is used. It is never longer than PollInterval.
+	FastPollInterval time.Duration
+
+	// IdlePollInterval is the interval at which the MyPlace system is read
+	// once it is idle. If it is zero, DefaultIdlePollInterval is used. It is
+	// never shorter than PollInterval.
+	IdlePollInterval time.Duration
+
+	// IdleAfter is the amount of time without any writes or refresh requests
+	// after which the MyPlace system is considered idle. If it is zero,
+	// DefaultIdleAfter is used.
+	IdleAfter time.Duration
+
+	// MaxPollBackoff is the maximum interval between attempts to read the
+	// MyPlace system when it is returning errors. The interval doubles with
+	// each consecutive error. If it is zero, DefaultMaxPollBackoff is used.
+	MaxPollBackoff time.Duration
+
+	// RetryInterval is the amount of time to wait for the MyPlace system to
+	// reflect a command before sending it again. If it is zero,
+	// DefaultRetryInterval is used.
+	RetryInterval time.Duration
+
+	// MaxAttempts is the number of times a command is sent before the
+	// reconciler gives up on it. If it is zero, DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	// MaxBatchSize is the maximum number of commands sent in a single
+	// request. If it is zero, DefaultMaxBatchSize is used.
+	//
+	// If there are more commands than fit in a single request, they are
+	// shared evenly between the air-conditioning units.
+	MaxBatchSize int
+
+	// OnRead, if non-nil, is called with the raw and parsed state each time the
+	// MyPlace system is read successfully.
+	OnRead func(data []byte, s *myplace.System)
+
+	// OnWrite, if non-nil, is called with each batch of commands before it is
+	// sent to the MyPlace system.
+	OnWrite func(commands []myplace.Command)
+
+	// StaleAfter is the amount of time after which the state of an
+	// air-conditioning unit is considered stale, either because the unit has
+	// not been read successfully, or because the commands sent to it have been
+	// failing, for that long. If it is zero, DefaultStaleAfter is used.
+	StaleAfter time.Duration
+
+	// OnStale, if non-nil, is called with the ID of an air-conditioning unit
+	// when its state becomes stale, and again when it is no longer stale.
+	OnStale func(unitID string, isStale bool)
+
+	// OnWriteFailed, if non-nil, is called with the ID of an air-conditioning
+	// unit when the reconciler gives up on a command sent to it, either
+	// because the requests fail or because the unit does not reflect the
+	// command after MaxAttempts. It is not called for requests that fail
+	// while the command is still being retried.
+	OnWriteFailed func(unitID string, err error)
+
+	refreshOnce sync.Once
+	refresh     chan struct{}
+
+	desired   map[string]*desired
+	seq       uint64
+	actual    map[string]any
+	readAt    time.Time
+	writtenAt map[string]time.Time
+	lastUnit  string
+	units     map[string]*unit
+
+	polledAt  time.Time
+	activeAt  time.Time
+	failures  int
+	isRefresh bool
+}
+
+// desired is a command that has not yet been reflected by the MyPlace system.
+type desired struct {
+	Command   myplace.Command
+	Changes   map[string]any
+	Unit      string
+	Seq       uint64
+	Attempts  int
+	SentAt    time.Time
+	Abandoned bool
+}
+
+// unit is the health of the connection to a single air-conditioning unit.
+type unit struct {
+	// ReadAt is the time at which the most recent successful read that
+	// included the unit began.
+	ReadAt time.Time
+
+	// WrittenAt is the time at which commands were last sent to the unit
+	// successfully.
+	WrittenAt time.Time
+
+	// IsFailing is true if the most recent attempt to send commands to the
+	// unit failed.
+	IsFailing bool
+
+	// IsStale is true if the unit's state is stale.
+	IsStale bool
+}
+
+// Refresh requests that the MyPlace system is read as soon as possible.
+//
+// It does not block, and may be called concurrently with Run.
+func (r *Reconciler) Refresh() {
+	select {
+	case r.refreshChan() <- struct{}{}:
+	default:
+	}
+}
+
+// Run reads and writes the MyPlace system until ctx is canceled.
+//
+// Run must not be called concurrently.
+func (r *Reconciler) Run(ctx context.Context) error {
+	r.desired = map[string]*desired{}
+	r.writtenAt = map[string]time.Time{}
+	r.units = map[string]*unit{}
+	r.activeAt = r.now()
+	r.isRefresh = true
+
+	for {
+		if r.isRefresh || !r.now().Before(r.nextRead()) {
+			r.isRefresh = false
+			r.read(ctx)
+		}
+
+		r.write(ctx)
+		r.checkStale()
+
+		wait := r.nextRead().Sub(r.now())
+		if at, ok := r.nextWrite(); ok {
+			if d := at.Sub(r.now()); d < wait {
+				wait = d
+			}
+		}
+		if at, ok := r.nextStale(); ok {
+			if d := at.Sub(r.now()); d < wait {
+				wait = d
+			}
+		}
+
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case commands := <-r.Commands:
+			r.desire(commands)
+		case <-r.refreshChan():
+			r.isRefresh = true
+			r.activeAt = r.now()
+		case <-r.clock().After(wait):
+		}
+	}
+}
+
+// nextRead returns the time at which the MyPlace system is next due to be
+// read.
+//
+// The system is read more often while it is converging on the desired state,
+// less often once it is idle, and increasingly less often while it is
+// returning errors.
+func (r *Reconciler) nextRead() time.Time {
+	d := r.pollInterval()
+
+	if r.failures != 0 {
+		for i := 0; i < r.failures && d < r.maxPollBackoff(); i++ {
+			d *= 2
+		}
+
+		if d > r.maxPollBackoff() {
+			d = r.maxPollBackoff()
+		}
+	} else if r.isConverging() {
+		if f := r.fastPollInterval(); f < d {
+			d = f
+		}
+	} else if !r.now().Before(r.activeAt.Add(r.idleAfter())) {
+		if i := r.idlePollInterval(); i > d {
+			d = i
+		}
+	}
+
+	return r.polledAt.Add(d)
+}
+
+// read updates the actual state from the MyPlace system.
+func (r *Reconciler) read(ctx context.Context) {
+	at := r.now()
+
+	defer func() {
+		r.polledAt = r.now()
+	}()
+
+	data, err := r.Client.ReadRaw(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Print(err)
+			r.failures++
+		}
+		return
+	}
+
+	s, err := myplace.ParseSystem(data)
+	if err != nil {
+		log.Print(err)
+		r.failures++
+		return
+	}
+
+	r.failures = 0
+
+	r.actual = s.Values()
+	r.readAt = at
+
+	for id := range s.AirConByID {
+		r.unit(id).ReadAt = at
+	}
+
+	if r.OnRead != nil {
+		r.OnRead(data, s)
+	}
+}
+
+// desire adds commands to the desired state, replacing any existing commands
+// that change the same settings.
+func (r *Reconciler) desire(commands []myplace.Command) {
+	for _, c := range commands {
+		changes := c.Changes()
+		if len(changes) == 0 {
+			continue
+		}
+
+		var paths []string
+		for p := range changes {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		key := strings.Join(paths, ",")
+
+		// Sending the same command repeatedly does not reset its attempts, so
+		// that a command the system never reflects is eventually abandoned,
+		// and does not revive a command once it has been abandoned.
+		if d, ok := r.desired[key]; ok && reflect.DeepEqual(d.Changes, changes) {
+			continue
+		}
+
+		for k, d := range r.desired {
+			for p := range changes {
+				if _, ok := d.Changes[p]; ok {
+					delete(r.desired, k)
+					break
+				}
+			}
+		}
+
+		unit, _, _ := strings.Cut(paths[0], ".")
+
+		r.seq++
+		r.desired[key] = &desired{
+			Command: c,
+			Changes: changes,
+			Unit:    unit,
+			Seq:     r.seq,
+		}
+	}
+}
+
+// write sends the commands that are due to be sent.
+func (r *Reconciler) write(ctx context.Context) {
+	now := r.now()
+	var due []*desired
+
+	for k, d := range r.desired {
+		if r.isReflected(d) {
+			delete(r.desired, k)
+			continue
+		}
+
+		if d.Abandoned {
+			continue
+		}
+
+		if d.Attempts == 0 {
+			due = append(due, d)
+			continue
+		}
+
+		if now.Before(d.SentAt.Add(r.retryInterval())) {
+			continue
+		}
+
+		if d.Attempts >= r.maxAttempts() {
+			log.Printf("giving up on '%s' after %d attempts", d.Command, d.Attempts)
+
+			// The command is kept, rather than deleted, so that it is not sent
+			// again each time it is resubmitted with the same value.
+			d.Abandoned = true
+
+			if r.OnWriteFailed != nil {
+				r.OnWriteFailed(
+					d.Unit,
+					fmt.Errorf("'%s' was not applied after %d attempts", d.Command, d.Attempts),
+				)
+			}
+
+			continue
+		}
+
+		due = append(due, d)
+	}
+
+	batch := r.batch(due)
+	if len(batch) == 0 {
+		return
+	}
+
+	commands := make([]myplace.Command, len(batch))
+	for i, d := range batch {
+		commands[i] = d.Command
+
+		if d.Attempts != 0 {
+			log.Printf("retrying '%s'", d.Command)
+		}
+	}
+
+	if r.OnWrite != nil {
+		r.OnWrite(commands)
+	}
+
+	err := r.Client.Write(ctx, commands...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Print(err)
+	}
+
+	r.activeAt = now
+
+	for _, d := range batch {
+		d.Attempts++
+		d.SentAt = now
+
+		// The system is permitted to ignore best-effort commands, so there is
+		// no point waiting for it to reflect them.
+		if d.Command.IsBestEffort() {
+			d.Abandoned = true
+		}
+
+		for p := range d.Changes {
+			r.writtenAt[p] = now
+		}
+
+		u := r.unit(d.Unit)
+		if err == nil {
+			u.WrittenAt = now
+			u.IsFailing = false
+		} else {
+			u.IsFailing = true
+		}
+	}
+}
+
+// unit returns the health of the air-conditioning unit with the given ID.
+//
+// A unit that has not been seen before is treated as having been read and
+// written successfully just now, so that it is not immediately stale.
+func (r *Reconciler) unit(id string) *unit {
+	u, ok := r.units[id]
+	if !ok {
+		now := r.now()
+		u = &unit{ReadAt: now, WrittenAt: now}
+		r.units[id] = u
+	}
+
+	return u
+}
+
+// checkStale updates the staleness of each air-conditioning unit, and calls
+// OnStale for each unit whose staleness has changed.
+func (r *Reconciler) checkStale() {
+	now := r.now()
+
+	for _, id := range sortedKeys(r.units) {
+		u := r.units[id]
+
+		at := r.staleAt(u)
+		isStale := !now.Before(at)
+
+		if isStale == u.IsStale {
+			continue
+		}
+
+		u.IsStale = isStale
+
+		if isStale {
+			log.Printf("the state of '%s' is stale", id)
+		} else {
+			log.Printf("the state of '%s' is no longer stale", id)
+		}
+
+		if r.OnStale != nil {
+			r.OnStale(id, isStale)
+		}
+	}
+}
+
+// staleAt returns the time at which the unit's state becomes stale, given its
+// current health.
+func (r *Reconciler) staleAt(u *unit) time.Time {
+	at := u.ReadAt.Add(r.staleAfter())
+
+	if u.IsFailing {
+		if w := u.WrittenAt.Add(r.staleAfter()); w.Before(at) {
+			at = w
+		}
+	}
+
+	return at
+}
+
+// nextStale returns the time at which the next air-conditioning unit that is
+// not yet stale becomes stale, if there are any such units.
+func (r *Reconciler) nextStale() (time.Time, bool) {
+	var next time.Time
+	ok := false
+
+	for _, u := range r.units {
+		if u.IsStale {
+			continue
+		}
+
+		if at := r.staleAt(u); !ok || at.Before(next) {
+			next = at
+			ok = true
+		}
+	}
+
+	return next, ok
+}
+
+// isReflected returns true if the actual state reflects the given command.
+//
+// Only reads that began after the command's settings were last written are
+// considered, as earlier reads may not include the effect of that write.
+func (r *Reconciler) isReflected(d *desired) bool {
+	for p, v := range d.Changes {
+		if !r.readAt.After(r.writtenAt[p]) {
+			return false
+		}
+
+		if a, ok := r.actual[p]; !ok || a != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// batch returns the commands to send in the next request, taken in turn from
+// each air-conditioning unit, in the order they were received.
+func (r *Reconciler) batch(due []*desired) []*desired {
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Seq < due[j].Seq
+	})
+
+	queues := map[string][]*desired{}
+	var units []string
+
+	for _, d := range due {
+		if _, ok := queues[d.Unit]; !ok {
+			units = append(units, d.Unit)
+		}
+		queues[d.Unit] = append(queues[d.Unit], d)
+	}
+
+	sort.Strings(units)
+
+	// Start with the unit after the one that was served last.
+	start := sort.SearchStrings(units, r.lastUnit)
+	if start < len(units) && units[start] == r.lastUnit {
+		start++
+	}
+	units = append(append([]string{}, units[start:]...), units[:start]...)
+
+	var batch []*desired
+
+	for len(batch) < r.maxBatchSize() && len(queues) != 0 {
+		for _, u := range units {
+			q, ok := queues[u]
+			if !ok {
+				continue
+			}
+
+			batch = append(batch, q[0])
+			r.lastUnit = u
+
+			if len(q) == 1 {
+				delete(queues, u)
+			} else {
+				queues[u] = q[1:]
+			}
+
+			if len(batch) == r.maxBatchSize() {
+				break
+			}
+		}
+	}
+
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].Seq < batch[j].Seq
+	})
+
+	return batch
+}
+
+// isConverging returns true if there are commands that the MyPlace system
+// does not yet reflect and that have not been abandoned.
+func (r *Reconciler) isConverging() bool {
+	for _, d := range r.desired {
+		if !d.Abandoned {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextWrite returns the time at which the next command is due to be sent, if
+// there are any outstanding commands.
+func (r *Reconciler) nextWrite() (time.Time, bool) {
+	var next time.Time
+	ok := false
+
+	for _, d := range r.desired {
+		if d.Abandoned {
+			continue
+		}
+
+		at := r.now()
+		if d.Attempts != 0 {
+			at = d.SentAt.Add(r.retryInterval())
+		}
+
+		if !ok || at.Before(next) {
+			next = at
+			ok = true
+		}
+	}
+
+	return next, ok
+}
+
+func (r *Reconciler) now() time.Time {
+	return r.clock().Now()
+}
+
+func (r *Reconciler) clock() Clock {
+	if r.Clock != nil {
+		return r.Clock
+	}
+
+	return systemClock{}
+}
+
+func (r *Reconciler) pollInterval() time.Duration {
+	if r.PollInterval != 0 {
+		return r.PollInterval
+	}
+
+	return DefaultPollInterval
+}
+
+func (r *Reconciler) fastPollInterval() time.Duration {
+	if r.FastPollInterval != 0 {
+		return r.FastPollInterval
+	}
+
+	return DefaultFastPollInterval
+}
+
+func (r *Reconciler) idlePollInterval() time.Duration {
+	if r.IdlePollInterval != 0 {
+		return r.IdlePollInterval
+	}
+
+	return DefaultIdlePollInterval
+}
+
+func (r *Reconciler) idleAfter() time.Duration {
+	if r.IdleAfter != 0 {
+		return r.IdleAfter
+	}
+
+	return DefaultIdleAfter
+}
+
+func (r *Reconciler) maxPollBackoff() time.Duration {
+	if r.MaxPollBackoff != 0 {
+		return r.MaxPollBackoff
+	}
+
+	return DefaultMaxPollBackoff
+}
+
+func (r *Reconciler) refreshChan() chan struct{} {
+	r.refreshOnce.Do(func() {
+		r.refresh = make(chan struct{}, 1)
+	})
+
+	return r.refresh
+}
+
+func (r *Reconciler) retryInterval() time.Duration {
+	if r.RetryInterval != 0 {
+		return r.RetryInterval
+	}
+
+	return DefaultRetryInterval
+}
+
+func (r *Reconciler) maxAttempts() int {
+	if r.MaxAttempts != 0 {
+		return r.MaxAttempts
+	}
+
+	return DefaultMaxAttempts
+}
+
+func (r *Reconciler) staleAfter() time.Duration {
+	if r.StaleAfter != 0 {
+		return r.StaleAfter
+	}
+
+	return DefaultStaleAfter
+}
+
+func (r *Reconciler) maxBatchSize() int {
+	if r.MaxBatchSize != 0 {
+		return r.MaxBatchSize
+	}
+
+	return DefaultMaxBatchSize
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// systemClock is a Clock that uses the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
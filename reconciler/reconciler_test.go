@@ -0,0 +1,551 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestReconciler_sendsOnlyUnreflectedCommands(t *testing.T) {
+	h := newHarness(t, &Reconciler{})
+
+	z := &myplace.Zone{ID: "z01", Number: 1, Name: "Living"}
+	h.submit(
+		myplace.SetAirConPower("ac1", myplace.AirConPowerOn),
+		myplace.SetZoneState("ac1", z, myplace.ZoneStateOpen),
+		myplace.SetAirConMode("ac1", myplace.AirConModeHeat),
+		myplace.SetZoneState("ac1", z, myplace.ZoneStateClosed),
+	)
+
+	h.expectWrite("set ac1 mode to heat")
+
+	h.client.setMode(myplace.AirConModeHeat)
+	h.expectNoWrite(time.Minute)
+}
+
+func TestReconciler_retries(t *testing.T) {
+	t.Run("it resends commands that are not reflected", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectWrite("set ac1 mode to heat")
+
+		start := h.clock.Now()
+
+		h.expectWrite("set ac1 mode to heat")
+		if d := h.clock.Now().Sub(start); d != DefaultRetryInterval {
+			t.Fatalf("unexpected retry interval: got %s, want %s", d, DefaultRetryInterval)
+		}
+
+		h.expectWrite("set ac1 mode to heat")
+		h.expectNoWrite(time.Minute)
+	})
+
+	t.Run("it stops once the command is reflected", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectWrite("set ac1 mode to heat")
+
+		h.client.setMode(myplace.AirConModeHeat)
+		h.expectNoWrite(time.Minute)
+	})
+
+	t.Run("it does not reset the attempts when the same command is resubmitted", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{MaxAttempts: 1})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectWrite("set ac1 mode to heat")
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectNoWrite(time.Minute)
+	})
+
+	t.Run("it does not resend an abandoned command until a different value is desired", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{MaxAttempts: 1})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectWrite("set ac1 mode to heat")
+		h.expectEvent("ac1 write failed: 'set ac1 mode to heat' was not applied after 1 attempts")
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectNoWrite(time.Minute)
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeDry))
+		h.expectWrite("set ac1 mode to dry")
+	})
+
+	t.Run("it does not retry best-effort commands", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat).BestEffort())
+		h.expectWrite("set ac1 mode to heat")
+		h.expectReadInterval(DefaultPollInterval)
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat).BestEffort())
+		h.expectNoWrite(time.Minute)
+
+		select {
+		case e := <-h.events:
+			t.Fatalf("unexpected event: %s", e)
+		default:
+		}
+	})
+
+	t.Run("it sends a replacement command immediately", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectWrite("set ac1 mode to heat")
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeDry))
+		h.expectWrite("set ac1 mode to dry")
+	})
+}
+
+func TestReconciler_fairness(t *testing.T) {
+	h := newHarness(t, &Reconciler{MaxBatchSize: 2})
+
+	z := &myplace.Zone{ID: "z01", Number: 1, Name: "Living"}
+	h.submit(
+		myplace.SetAirConMode("ac1", myplace.AirConModeHeat),
+		myplace.SetZoneState("ac1", z, myplace.ZoneStateOpen),
+		myplace.SetZoneTargetTemp("ac1", z, 22),
+		myplace.SetAirConMode("ac2", myplace.AirConModeHeat),
+	)
+
+	h.expectWrite(
+		"set ac1 mode to heat",
+		"set ac2 mode to heat",
+	)
+
+	h.expectWrite(
+		"set ac1#1 (Living) to on",
+		"set ac1#1 (Living) target temperature to 22.0°C",
+	)
+}
+
+func TestReconciler_polling(t *testing.T) {
+	t.Run("it polls at the poll interval", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+		h.expectReadInterval(DefaultPollInterval)
+		h.expectReadInterval(DefaultPollInterval)
+	})
+
+	t.Run("it polls quickly while the system is converging", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectReadInterval(DefaultFastPollInterval)
+		h.expectReadInterval(DefaultFastPollInterval)
+
+		h.client.setMode(myplace.AirConModeHeat)
+		h.expectReadInterval(DefaultFastPollInterval)
+		h.expectReadInterval(DefaultPollInterval)
+	})
+
+	t.Run("it stops polling quickly once a command is abandoned", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{MaxAttempts: 1})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectWrite("set ac1 mode to heat")
+		h.expectReadInterval(DefaultFastPollInterval)
+		h.expectEvent("ac1 write failed: 'set ac1 mode to heat' was not applied after 1 attempts")
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectReadInterval(DefaultPollInterval)
+		h.expectReadInterval(DefaultPollInterval)
+
+		for h.clock.Now().Before(h.start.Add(DefaultIdleAfter)) {
+			h.clock.tick(t)
+		}
+
+		h.expectReadInterval(DefaultIdlePollInterval)
+	})
+
+	t.Run("it polls slowly once the system is idle", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		for h.clock.Now().Before(h.start.Add(DefaultIdleAfter)) {
+			h.clock.tick(t)
+		}
+
+		h.expectReadInterval(DefaultIdlePollInterval)
+		h.expectReadInterval(DefaultIdlePollInterval)
+	})
+
+	t.Run("it backs off while the panel returns errors", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{MaxPollBackoff: 10 * time.Second})
+
+		h.client.setFailing(true)
+		h.expectReadInterval(DefaultPollInterval)
+		h.expectReadInterval(2 * DefaultPollInterval)
+		h.expectReadInterval(4 * DefaultPollInterval)
+		h.expectReadInterval(10 * time.Second)
+
+		h.client.setFailing(false)
+		h.expectReadInterval(10 * time.Second)
+		h.expectReadInterval(DefaultPollInterval)
+	})
+
+	t.Run("it polls immediately when a refresh is requested", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		for h.clock.Now().Before(h.start.Add(DefaultIdleAfter)) {
+			h.clock.tick(t)
+		}
+
+		h.reconciler.Refresh()
+		h.clock.wait(t)
+
+		if at, now := h.lastRead(), h.clock.Now(); at != now {
+			t.Fatalf("unexpected read time: got %s, want %s", at, now)
+		}
+
+		h.expectReadInterval(DefaultPollInterval)
+	})
+}
+
+func TestReconciler_staleness(t *testing.T) {
+	t.Run("it reports a unit as stale while it can not be read", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{})
+
+		h.client.setFailing(true)
+		h.expectEvent("ac1 is stale")
+
+		if d := h.clock.Now().Sub(h.start); d != DefaultStaleAfter {
+			t.Fatalf("unexpected staleness period: got %s, want %s", d, DefaultStaleAfter)
+		}
+
+		h.client.setFailing(false)
+		h.expectEvent("ac1 is not stale")
+	})
+
+	t.Run("it reports a unit as stale while it can not be written", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{StaleAfter: 25 * time.Second})
+
+		h.client.setWriteFailing(true)
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+
+		failedAt := h.clock.Now()
+
+		h.expectEvent("ac1 is stale")
+
+		if d := h.clock.Now().Sub(failedAt); d != 25*time.Second {
+			t.Fatalf("unexpected staleness period: got %s, want %s", d, 25*time.Second)
+		}
+
+		h.client.setWriteFailing(false)
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeDry))
+		h.expectEvent("ac1 is not stale")
+	})
+
+	t.Run("it reports commands that can not be written once it gives up", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{MaxAttempts: 2})
+
+		h.client.setWriteFailing(true)
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+
+		failedAt := h.clock.Now()
+
+		h.expectEvent("ac1 write failed: 'set ac1 mode to heat' was not applied after 2 attempts")
+
+		if d := h.clock.Now().Sub(failedAt); d != 2*DefaultRetryInterval {
+			t.Fatalf("unexpected failure period: got %s, want %s", d, 2*DefaultRetryInterval)
+		}
+	})
+
+	t.Run("it reports commands that are never reflected", func(t *testing.T) {
+		h := newHarness(t, &Reconciler{MaxAttempts: 1})
+
+		h.submit(myplace.SetAirConMode("ac1", myplace.AirConModeHeat))
+		h.expectWrite("set ac1 mode to heat")
+		h.expectEvent("ac1 write failed: 'set ac1 mode to heat' was not applied after 1 attempts")
+	})
+}
+
+// harness runs a reconciler against a fake clock and client.
+type harness struct {
+	t          *testing.T
+	start      time.Time
+	clock      *fakeClock
+	client     *fakeClient
+	commands   chan []myplace.Command
+	events     chan string
+	reconciler *Reconciler
+}
+
+// newHarness starts r using a fake clock and client.
+func newHarness(t *testing.T, r *Reconciler) *harness {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{
+		now:     start,
+		waiting: make(chan struct{}, 1),
+	}
+
+	h := &harness{
+		t:     t,
+		start: start,
+		clock: clock,
+		client: &fakeClient{
+			clock:  clock,
+			mode:   myplace.AirConModeCool,
+			writes: make(chan []string, 100),
+		},
+		commands:   make(chan []myplace.Command, 100),
+		events:     make(chan string, 100),
+		reconciler: r,
+	}
+
+	r.Client = h.client
+	r.Clock = h.clock
+	r.Commands = h.commands
+
+	r.OnStale = func(unitID string, isStale bool) {
+		if isStale {
+			h.events <- unitID + " is stale"
+		} else {
+			h.events <- unitID + " is not stale"
+		}
+	}
+
+	r.OnWriteFailed = func(unitID string, err error) {
+		h.events <- fmt.Sprintf("%s write failed: %s", unitID, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go r.Run(ctx)
+	h.clock.wait(t)
+
+	return h
+}
+
+// submit sends commands to the reconciler and waits for it to process them.
+func (h *harness) submit(commands ...myplace.Command) {
+	h.t.Helper()
+	h.commands <- commands
+	h.clock.wait(h.t)
+}
+
+// expectWrite advances the clock until the reconciler writes to the client,
+// and checks that the expected commands were written.
+func (h *harness) expectWrite(expect ...string) {
+	h.t.Helper()
+
+	for i := 0; i < 100; i++ {
+		select {
+		case actual := <-h.client.writes:
+			if fmt.Sprint(actual) != fmt.Sprint(expect) {
+				h.t.Fatalf("unexpected commands: got %v, want %v", actual, expect)
+			}
+			return
+		default:
+			h.clock.tick(h.t)
+		}
+	}
+
+	h.t.Fatal("expected a write")
+}
+
+// expectNoWrite advances the clock by at least d and checks that the
+// reconciler does not write to the client.
+func (h *harness) expectNoWrite(d time.Duration) {
+	h.t.Helper()
+
+	until := h.clock.Now().Add(d)
+
+	for h.clock.Now().Before(until) {
+		select {
+		case actual := <-h.client.writes:
+			h.t.Fatalf("unexpected commands: %v", actual)
+		default:
+			h.clock.tick(h.t)
+		}
+	}
+}
+
+// expectEvent advances the clock until the reconciler reports a change in the
+// health of a unit, and checks that it is the expected change.
+func (h *harness) expectEvent(expect string) {
+	h.t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		select {
+		case actual := <-h.events:
+			if actual != expect {
+				h.t.Fatalf("unexpected event: got %q, want %q", actual, expect)
+			}
+			return
+		default:
+			h.clock.tick(h.t)
+		}
+	}
+
+	h.t.Fatalf("expected %q", expect)
+}
+
+// expectReadInterval advances the clock until the reconciler next reads from
+// the client, and checks the time since the previous read.
+func (h *harness) expectReadInterval(expect time.Duration) {
+	h.t.Helper()
+
+	prev := h.lastRead()
+
+	for i := 0; i < 100; i++ {
+		if at := h.lastRead(); at != prev {
+			if d := at.Sub(prev); d != expect {
+				h.t.Fatalf("unexpected poll interval: got %s, want %s", d, expect)
+			}
+			return
+		}
+
+		h.clock.tick(h.t)
+	}
+
+	h.t.Fatal("expected a read")
+}
+
+// lastRead returns the time of the most recent read.
+func (h *harness) lastRead() time.Time {
+	h.client.m.Lock()
+	defer h.client.m.Unlock()
+	return h.client.readAt
+}
+
+// fakeClock is a Clock that only advances when tick() is called.
+//
+// It supports a single pending timer, which is sufficient for the reconciler
+// as it waits on one timer at a time.
+type fakeClock struct {
+	m        sync.Mutex
+	now      time.Time
+	timer    chan time.Time
+	deadline time.Time
+	waiting  chan struct{}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.m.Lock()
+	c.timer = make(chan time.Time, 1)
+	c.deadline = c.now.Add(d)
+	timer := c.timer
+	c.m.Unlock()
+
+	c.waiting <- struct{}{}
+
+	return timer
+}
+
+// wait blocks until the reconciler is waiting on the clock.
+func (c *fakeClock) wait(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-c.waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reconciler")
+	}
+}
+
+// tick advances the clock to the deadline of the pending timer, fires it, then
+// waits for the reconciler to wait on the clock again.
+func (c *fakeClock) tick(t *testing.T) {
+	t.Helper()
+
+	c.m.Lock()
+	if c.deadline.After(c.now) {
+		c.now = c.deadline
+	}
+	c.timer <- c.now
+	c.m.Unlock()
+
+	c.wait(t)
+}
+
+// fakeClient is a Client with a single air-conditioning unit that has a single
+// closed zone, which records the commands that are written.
+type fakeClient struct {
+	clock  *fakeClock
+	writes chan []string
+
+	m             sync.Mutex
+	mode          myplace.AirConMode
+	failing       bool
+	writesFailing bool
+	readAt        time.Time
+}
+
+func (c *fakeClient) setFailing(v bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.failing = v
+}
+
+func (c *fakeClient) setWriteFailing(v bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.writesFailing = v
+}
+
+func (c *fakeClient) setMode(m myplace.AirConMode) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.mode = m
+}
+
+func (c *fakeClient) ReadRaw(context.Context) ([]byte, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.readAt = c.clock.Now()
+
+	if c.failing {
+		return nil, errors.New("<error>")
+	}
+
+	return []byte(fmt.Sprintf(
+		`{
+			"system": {"myAppRev": "15.0"},
+			"aircons": {
+				"ac1": {
+					"info": {"name": "AC", "state": "on", "mode": %q, "myZone": 1},
+					"zones": {
+						"z01": {"name": "Living", "number": 1, "state": "close", "setTemp": 24}
+					}
+				}
+			}
+		}`,
+		c.mode,
+	)), nil
+}
+
+func (c *fakeClient) Write(_ context.Context, commands ...myplace.Command) error {
+	var desc []string
+	for _, cmd := range commands {
+		desc = append(desc, cmd.String())
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.writesFailing {
+		return errors.New("<error>")
+	}
+
+	c.writes <- desc
+
+	return nil
+}
@@ -0,0 +1,5 @@
+// Package recording reads and writes timelines of MyPlace system state and the
+// commands sent to the MyPlace API.
+//
+// A recording is a JSONL file. Each line is a single Entry.
+package recording
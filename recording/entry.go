@@ -0,0 +1,32 @@
+package recording
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Entry is a single entry within a recording.
+//
+// Each entry contains either a snapshot of the system state, or the commands
+// sent to the API server.
+type Entry struct {
+	// Time is the time at which the entry was recorded.
+	Time time.Time `json:"time"`
+
+	// System is the JSON representation of the entire system, as returned by
+	// the "/getSystemData" API endpoint.
+	System json.RawMessage `json:"system,omitempty"`
+
+	// Commands contains human-readable descriptions of the commands that were
+	// sent to the API server.
+	Commands []string `json:"commands,omitempty"`
+
+	// Request is the JSON representation of the request that was sent to the
+	// "/setAircon" API endpoint.
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// IsSystem returns true if the entry contains a snapshot of the system state.
+func (e Entry) IsSystem() bool {
+	return len(e.System) != 0
+}
@@ -0,0 +1,27 @@
+package recording
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Reader reads entries from a recording.
+type Reader struct {
+	dec *json.Decoder
+}
+
+// NewReader returns a reader that reads entries from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		dec: json.NewDecoder(r),
+	}
+}
+
+// Next returns the next entry in the recording.
+//
+// It returns io.EOF if there are no more entries.
+func (r *Reader) Next() (Entry, error) {
+	var e Entry
+	err := r.dec.Decode(&e)
+	return e, err
+}
@@ -0,0 +1,95 @@
+package recording
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+func TestWriterAndReader(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	t1 := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	t2 := t1.Add(time.Second)
+
+	if err := w.WriteSystem(t1, []byte("{\n  \"aircons\": {}\n}")); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := []myplace.Command{
+		myplace.SetAirConPower("ac1", myplace.AirConPowerOn),
+		myplace.SetAirConMode("ac1", myplace.AirConModeHeat),
+	}
+
+	if err := w.WriteCommands(t2, commands...); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("it writes one entry per line", func(t *testing.T) {
+		if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 2 {
+			t.Fatalf("unexpected number of lines: got %d, want 2", n)
+		}
+	})
+
+	req, err := myplace.MarshalCommands(commands...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+
+	t.Run("it reads the system snapshot", func(t *testing.T) {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !e.IsSystem() {
+			t.Fatal("expected a system snapshot")
+		}
+
+		if !e.Time.Equal(t1) {
+			t.Fatalf("unexpected time: got %s, want %s", e.Time, t1)
+		}
+
+		if string(e.System) != `{"aircons":{}}` {
+			t.Fatalf("unexpected system data: %s", e.System)
+		}
+	})
+
+	t.Run("it reads the commands", func(t *testing.T) {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.IsSystem() {
+			t.Fatal("did not expect a system snapshot")
+		}
+
+		if !e.Time.Equal(t2) {
+			t.Fatalf("unexpected time: got %s, want %s", e.Time, t2)
+		}
+
+		expect := []string{commands[0].String(), commands[1].String()}
+		if !reflect.DeepEqual(e.Commands, expect) {
+			t.Fatalf("unexpected commands: got %v, want %v", e.Commands, expect)
+		}
+
+		if !bytes.Equal(e.Request, req) {
+			t.Fatalf("unexpected request: got %s, want %s", e.Request, req)
+		}
+	})
+
+	t.Run("it returns io.EOF at the end of the recording", func(t *testing.T) {
+		if _, err := r.Next(); !errors.Is(err, io.EOF) {
+			t.Fatalf("unexpected error: got %v, want io.EOF", err)
+		}
+	})
+}
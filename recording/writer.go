@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+// Writer writes entries to a recording.
+//
+// It is safe for concurrent use.
+type Writer struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+// NewWriter returns a writer that writes entries to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteSystem writes an entry containing a snapshot of the system state.
+//
+// data is the JSON representation of the entire system, as returned by the
+// "/getSystemData" API endpoint.
+func (w *Writer) WriteSystem(t time.Time, data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return err
+	}
+
+	return w.write(Entry{
+		Time:   t,
+		System: buf.Bytes(),
+	})
+}
+
+// WriteCommands writes an entry containing the commands sent to the API
+// server.
+func (w *Writer) WriteCommands(t time.Time, commands ...myplace.Command) error {
+	req, err := myplace.MarshalCommands(commands...)
+	if err != nil {
+		return err
+	}
+
+	e := Entry{
+		Time:    t,
+		Request: req,
+	}
+
+	for _, c := range commands {
+		e.Commands = append(e.Commands, c.String())
+	}
+
+	return w.write(e)
+}
+
+// write writes a single entry to the recording.
+func (w *Writer) write(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	_, err = w.w.Write(data)
+	return err
+}
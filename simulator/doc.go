@@ -0,0 +1,3 @@
+// Package simulator implements a MyPlace-compatible API server that serves
+// system state captured from a real MyAir Touch Panel.
+package simulator
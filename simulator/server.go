@@ -0,0 +1,136 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Server is an HTTP handler that implements the subset of the MyPlace API
+// used by AirKit.
+//
+// It serves the "/getSystemData" endpoint from an in-memory copy of the system
+// state, and applies requests made to the "/setAircon" endpoint to that copy.
+type Server struct {
+	m     sync.Mutex
+	state map[string]any
+}
+
+// New returns a server that serves the given system state.
+//
+// data is the JSON representation of the entire system, as returned by the
+// "/getSystemData" API endpoint.
+func New(data []byte) (*Server, error) {
+	state, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := state["aircons"].(map[string]any); !ok {
+		return nil, fmt.Errorf("system data does not contain any air-conditioning units")
+	}
+
+	return &Server{
+		state: state,
+	}, nil
+}
+
+// ServeHTTP handles an HTTP request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/getSystemData":
+		s.getSystemData(w, r)
+	case "/setAircon":
+		s.setAircon(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// getSystemData handles requests to the "/getSystemData" endpoint.
+func (s *Server) getSystemData(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	writeJSON(w, s.state)
+}
+
+// setAircon handles requests to the "/setAircon" endpoint.
+func (s *Server) setAircon(w http.ResponseWriter, r *http.Request) {
+	req, err := decode([]byte(r.URL.Query().Get("json")))
+	if err != nil {
+		writeAck(w, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	aircons := s.state["aircons"].(map[string]any)
+
+	for id := range req {
+		if _, ok := aircons[id]; !ok {
+			writeAck(w, fmt.Errorf("unknown air-conditioning unit: %s", id))
+			return
+		}
+	}
+
+	merge(aircons, req)
+	log.Printf("applied update: %s", r.URL.Query().Get("json"))
+
+	writeAck(w, nil)
+}
+
+// merge recursively merges the values in src into dst.
+func merge(dst, src map[string]any) {
+	for k, v := range src {
+		if s, ok := v.(map[string]any); ok {
+			if d, ok := dst[k].(map[string]any); ok {
+				merge(d, s)
+				continue
+			}
+		}
+
+		dst[k] = v
+	}
+}
+
+// decode parses a JSON object, preserving the literal representation of any
+// numbers.
+func decode(data []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v map[string]any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// writeAck writes the response to a request to the "/setAircon" endpoint.
+func writeAck(w http.ResponseWriter, err error) {
+	res := map[string]any{
+		"ack":     err == nil,
+		"request": "setAircon",
+	}
+
+	if err != nil {
+		res["reason"] = err.Error()
+	}
+
+	writeJSON(w, res)
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
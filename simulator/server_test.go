@@ -0,0 +1,128 @@
+package simulator
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jmalloc/airkit/myplace"
+)
+
+const systemData = `{
+	"aircons": {
+		"ac1": {
+			"info": {"name": "AC", "state": "off", "mode": "cool", "setTemp": 24.0},
+			"zones": {
+				"z01": {"number": 1, "name": "Living", "state": "open", "setTemp": 24.0},
+				"z02": {"number": 2, "name": "Kitchen", "state": "open", "setTemp": 24.0}
+			}
+		}
+	},
+	"system": {"name": "Home", "myAppRev": "15.0"}
+}`
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+
+	sim, err := New([]byte(systemData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(sim)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &myplace.Client{Host: host, Port: port}
+
+	sys, err := cli.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("it serves the system data", func(t *testing.T) {
+		ac := sys.AirConByID["ac1"]
+
+		if ac.Details.Name != "AC" || ac.Details.Power != myplace.AirConPowerOff {
+			t.Fatalf("unexpected unit: %+v", ac.Details)
+		}
+
+		if len(ac.Zones) != 2 {
+			t.Fatalf("unexpected number of zones: got %d, want 2", len(ac.Zones))
+		}
+	})
+
+	t.Run("it applies the commands that are written", func(t *testing.T) {
+		ac := sys.AirConByID["ac1"]
+
+		if err := cli.Write(
+			ctx,
+			myplace.SetAirConPower("ac1", myplace.AirConPowerOn),
+			myplace.SetZoneTargetTemp("ac1", ac.ZoneByID["z02"], 21),
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		sys, err := cli.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ac = sys.AirConByID["ac1"]
+
+		if ac.Details.Power != myplace.AirConPowerOn {
+			t.Fatalf("unexpected power: got %s, want %s", ac.Details.Power, myplace.AirConPowerOn)
+		}
+
+		if ac.Details.Mode != myplace.AirConModeCool {
+			t.Fatalf("unexpected mode: got %s, want %s", ac.Details.Mode, myplace.AirConModeCool)
+		}
+
+		if v := ac.ZoneByID["z01"].TargetTemp; v != 24 {
+			t.Fatalf("unexpected target temperature of z01: got %.1f, want 24.0", v)
+		}
+
+		if v := ac.ZoneByID["z02"].TargetTemp; v != 21 {
+			t.Fatalf("unexpected target temperature of z02: got %.1f, want 21.0", v)
+		}
+	})
+
+	t.Run("it rejects writes to unknown units", func(t *testing.T) {
+		err := cli.Write(ctx, myplace.SetAirConPower("ac2", myplace.AirConPowerOn))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("it responds with a 404 to unknown endpoints", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/getZoneData")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		io.Copy(io.Discard, res.Body)
+
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("unexpected status: got %d, want %d", res.StatusCode, http.StatusNotFound)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New([]byte(`{"system": {}}`)); err == nil {
+		t.Fatal("expected an error")
+	}
+}